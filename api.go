@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+type apiDevice struct {
+	Account string `json:"account"`
+	*smartthings.Device
+}
+
+type apiLocation struct {
+	Account string `json:"account"`
+	*smartthings.Location
+	Rooms []*smartthings.Room `json:"rooms"`
+}
+
+type apiMetric struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+type apiDeviceStatus struct {
+	Account  string                                 `json:"account"`
+	DeviceID string                                 `json:"deviceId"`
+	Time     time.Time                              `json:"time"`
+	Status   map[string]smartthings.ComponentStatus `json:"status"`
+	Metrics  []*apiMetric                           `json:"metrics"`
+	Error    string                                 `json:"error,omitempty"`
+}
+
+// DebugAPI serves the cached snapshots of the accounts as json, along
+// with the metrics derived from the status of a device. It never queries
+// the smartthings api, accounts that weren't polled yet are left out.
+type DebugAPI struct {
+	pollers []*Poller
+	mux     *http.ServeMux
+}
+
+func NewDebugAPI(pollers ...*Poller) *DebugAPI {
+	api := &DebugAPI{pollers: pollers, mux: http.NewServeMux()}
+	api.mux.HandleFunc("GET /api/devices", api.devices)
+	api.mux.HandleFunc("GET /api/devices/{id}", api.device)
+	api.mux.HandleFunc("GET /api/devices/{id}/status", api.deviceStatus)
+	api.mux.HandleFunc("GET /api/locations", api.locations)
+	return api
+}
+
+func (api *DebugAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+// snapshots returns the latest snapshots, limited to ?account= when set.
+func (api *DebugAPI) snapshots(r *http.Request) []*Snapshot {
+	account := r.URL.Query().Get("account")
+
+	var snapshots []*Snapshot
+	for _, poller := range api.pollers {
+		if account != "" && poller.Name() != account {
+			continue
+		}
+		if snapshot := poller.Status().Snapshot; snapshot != nil {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots
+}
+
+// findDevice looks the device up in every account.
+func (api *DebugAPI) findDevice(r *http.Request) (*Snapshot, *smartthings.Device) {
+	deviceId := r.PathValue("id")
+	for _, snapshot := range api.snapshots(r) {
+		for _, device := range snapshot.Devices {
+			if device.DeviceID == deviceId {
+				return snapshot, device
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (api *DebugAPI) devices(w http.ResponseWriter, r *http.Request) {
+	devices := make([]*apiDevice, 0)
+	for _, snapshot := range api.snapshots(r) {
+		for _, device := range snapshot.Devices {
+			devices = append(devices, &apiDevice{Account: snapshot.Account, Device: device})
+		}
+	}
+	writeJSON(w, devices)
+}
+
+func (api *DebugAPI) device(w http.ResponseWriter, r *http.Request) {
+	snapshot, device := api.findDevice(r)
+	if device == nil {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, &apiDevice{Account: snapshot.Account, Device: device})
+}
+
+func (api *DebugAPI) deviceStatus(w http.ResponseWriter, r *http.Request) {
+	snapshot, device := api.findDevice(r)
+	if device == nil {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	status := &apiDeviceStatus{
+		Account:  snapshot.Account,
+		DeviceID: device.DeviceID,
+		Time:     snapshot.Time,
+		Status:   snapshot.Status[device.DeviceID],
+	}
+	metrics, err := deviceMetrics(snapshot.Account, device, status.Status)
+	if err != nil {
+		// the metrics that could be gathered are still shown
+		status.Error = err.Error()
+	}
+	status.Metrics = metrics
+
+	writeJSON(w, status)
+}
+
+func (api *DebugAPI) locations(w http.ResponseWriter, r *http.Request) {
+	locations := make([]*apiLocation, 0)
+	for _, snapshot := range api.snapshots(r) {
+		for _, location := range snapshot.Locations {
+			rooms := make([]*smartthings.Room, 0)
+			for _, room := range snapshot.Rooms {
+				if room.LocationID == location.ID {
+					rooms = append(rooms, room)
+				}
+			}
+			locations = append(locations, &apiLocation{Account: snapshot.Account, Location: location, Rooms: rooms})
+		}
+	}
+	writeJSON(w, locations)
+}
+
+// deviceCollector collects the metrics of a single device.
+type deviceCollector struct {
+	account string
+	device  *smartthings.Device
+	status  map[string]smartthings.ComponentStatus
+}
+
+func (collector *deviceCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (collector *deviceCollector) Collect(metrics chan<- prometheus.Metric) {
+	registerDeviceMetrics(collector.account, collector.device, metrics)
+	for _, componentStatus := range collector.status {
+		registerComponentMetrics(collector.account, collector.device.DeviceID, componentStatus, metrics)
+	}
+}
+
+// deviceMetrics gathers the metrics of a device the way they are exposed on /metrics.
+func deviceMetrics(account string, device *smartthings.Device, status map[string]smartthings.ComponentStatus) ([]*apiMetric, error) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&deviceCollector{account: account, device: device, status: status})
+	families, err := registry.Gather()
+
+	metrics := make([]*apiMetric, 0)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			metrics = append(metrics, &apiMetric{Name: family.GetName(), Labels: labels, Value: metric.GetGauge().GetValue()})
+		}
+	}
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+
+	return metrics, err
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Warn("responding to api request failed", "error", err)
+	}
+}
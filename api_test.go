@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugAPI(t *testing.T) {
+	client := &fakeClient{
+		devices: []*smartthings.Device{{
+			DeviceID:   "dev-1",
+			Label:      "Porch Light",
+			LocationID: "loc-1",
+			Components: []*smartthings.Component{{ID: "main"}},
+		}},
+		locations: []*smartthings.Location{{ID: "loc-1", Name: "Home"}},
+		rooms:     []*smartthings.Room{{ID: "room-1", LocationID: "loc-1", Name: "Porch"}},
+		statuses: map[string]smartthings.ComponentStatus{
+			"dev-1/main": {"switch": {"switch": {"value": "on"}}},
+		},
+	}
+	poller := NewPoller("home", client, "", DeviceFilter{}, 0)
+	api := NewDebugAPI(poller, NewPoller("unpolled", &fakeClient{}, "", DeviceFilter{}, 0))
+
+	get := func(path string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code == http.StatusOK {
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+		}
+		return rec.Code
+	}
+
+	var devices []map[string]interface{}
+	assert.Equal(t, http.StatusOK, get("/api/devices", &devices))
+	assert.Empty(t, devices, "nothing is served before the first poll")
+
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, get("/api/devices", &devices))
+	require.Len(t, devices, 1)
+	assert.Equal(t, "home", devices[0]["account"])
+	assert.Equal(t, "dev-1", devices[0]["deviceId"])
+	assert.Equal(t, http.StatusOK, get("/api/devices?account=unpolled", &devices))
+	assert.Empty(t, devices)
+
+	var device map[string]interface{}
+	assert.Equal(t, http.StatusOK, get("/api/devices/dev-1", &device))
+	assert.Equal(t, "Porch Light", device["label"])
+	assert.Equal(t, http.StatusNotFound, get("/api/devices/unknown", &device))
+
+	var status apiDeviceStatus
+	assert.Equal(t, http.StatusOK, get("/api/devices/dev-1/status", &status))
+	assert.Equal(t, "on", status.Status["main"]["switch"]["switch"]["value"])
+	assert.Contains(t, status.Metrics, &apiMetric{
+		Name:   "smartthings_attribute_switch",
+		Labels: map[string]string{"account": "home", "deviceId": "dev-1", "componentId": "switch"},
+		Value:  1,
+	})
+
+	var locations []*apiLocation
+	assert.Equal(t, http.StatusOK, get("/api/locations", &locations))
+	require.Len(t, locations, 1)
+	assert.Equal(t, "Home", locations[0].Name)
+	require.Len(t, locations[0].Rooms, 1)
+	assert.Equal(t, "Porch", locations[0].Rooms[0].Name)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/devices", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
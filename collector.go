@@ -3,81 +3,139 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"strconv"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/setheck/smartthings-exporter/smartthings"
 )
 
+var upDesc = prometheus.NewDesc("smartthings_up",
+	"whether the last request to the smartthings api succeeded",
+	[]string{"account"}, nil)
+
 type Collector struct {
-	client SmartthingsClient
+	pollers  []*Poller
+	location string
+	room     string
 }
 
 type SmartthingsClient interface {
 	ListDevices(ctx context.Context) ([]*smartthings.Device, error)
+	ListLocations(ctx context.Context, params url.Values) ([]*smartthings.Location, error)
+	ListRooms(ctx context.Context, locationId string) ([]*smartthings.Room, error)
 	GetDeviceComponentStatus(ctx context.Context, deviceId, componentId string) (smartthings.ComponentStatus, error)
 }
 
-func NewCollector(client SmartthingsClient) *Collector {
-	return &Collector{client: client}
+func NewCollector(pollers ...*Poller) *Collector {
+	return &Collector{pollers: pollers}
 }
 
-func (collector *Collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+// NewLocationCollector only reports devices of the poller in the given
+// location, and in the given room when roomId is not empty.
+func NewLocationCollector(poller *Poller, locationId, roomId string) *Collector {
+	return &Collector{pollers: []*Poller{poller}, location: locationId, room: roomId}
 }
 
+// Describe sends no descriptors, the attribute metrics depend on the devices
+// found at collection time so the collector is registered as unchecked.
+func (collector *Collector) Describe(chan<- *prometheus.Desc) {}
+
 func (collector *Collector) Collect(metrics chan<- prometheus.Metric) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	devices, err := collector.client.ListDevices(ctx)
-	if err == nil {
-		for _, device := range devices {
-			registerDeviceMetrics(device, metrics)
-
-			for _, component := range device.Components {
-				componentStatus, err := collector.client.GetDeviceComponentStatus(ctx, device.DeviceID, component.ID)
-				if err == nil {
-					registerComponentMetrics(device.DeviceID, componentStatus, metrics)
-				} else {
-					log.Println("getDeviceComponentStatus deviceID:", device.DeviceID, "componentID:", component.ID, "failed, error:", err)
-				}
-			}
+	var wg sync.WaitGroup
+	for _, poller := range collector.pollers {
+		wg.Add(1)
+		go func(poller *Poller) {
+			defer wg.Done()
+			collector.collectAccount(ctx, poller, metrics)
+		}(poller)
+	}
+	wg.Wait()
+}
+
+func (collector *Collector) collectAccount(ctx context.Context, poller *Poller, metrics chan<- prometheus.Metric) {
+	snapshot, err := poller.Snapshot(ctx)
+	if err != nil {
+		slog.Error("collect account failed", "account", poller.Name(), "error", err)
+	}
+	collectSnapshot(poller.Name(), snapshot, err, collector.location, collector.room, metrics)
+}
+
+// collectSnapshot sends smartthings_up, 0 when err is set, and the
+// metrics of the devices of the snapshot in the location and room when
+// they are not empty. The snapshot may be nil after a failed poll.
+func collectSnapshot(account string, snapshot *Snapshot, err error, locationId, roomId string, metrics chan<- prometheus.Metric) {
+	up := float64(1)
+	if err != nil {
+		up = 0
+	}
+	metrics <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, up, account)
+	if snapshot == nil {
+		return
+	}
+
+	for _, device := range snapshot.Devices {
+		if locationId != "" && device.LocationID != locationId {
+			continue
+		}
+		if roomId != "" && device.RoomID != roomId {
+			continue
+		}
+		registerDeviceMetrics(account, device, metrics)
+
+		for _, componentStatus := range snapshot.Status[device.DeviceID] {
+			registerComponentMetrics(account, device.DeviceID, componentStatus, metrics)
 		}
-	} else {
-		log.Println("listDevices failed, error:", err)
 	}
 }
 
-func registerDeviceMetrics(device *smartthings.Device, metrics chan<- prometheus.Metric) {
+// snapshotCollector collects a snapshot that was already taken.
+type snapshotCollector struct {
+	account  string
+	snapshot *Snapshot
+	err      error
+	location string
+}
+
+func (collector *snapshotCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (collector *snapshotCollector) Collect(metrics chan<- prometheus.Metric) {
+	collectSnapshot(collector.account, collector.snapshot, collector.err, collector.location, "", metrics)
+}
+
+func registerDeviceMetrics(account string, device *smartthings.Device, metrics chan<- prometheus.Metric) {
 	if m, err := prometheus.NewConstMetric(
 		prometheus.NewDesc("smartthings_device",
 			"a registered device",
-			[]string{"deviceId", "deviceLabel", "name"}, nil),
+			[]string{"account", "deviceId", "deviceLabel", "name"}, nil),
 		prometheus.GaugeValue,
 		1,
-		device.DeviceID, device.Label, device.Name); err == nil {
+		account, device.DeviceID, device.Label, device.Name); err == nil {
 
 		metrics <- m
 	}
 	if m, err := prometheus.NewConstMetric(
 		prometheus.NewDesc("smartthings_device_info",
 			"information about the device",
-			[]string{"deviceId", "manufacturerName", "deviceManufacturerCode", "deviceTypeId", "deviceNetworkType"}, nil),
+			[]string{"account", "deviceId", "manufacturerName", "deviceManufacturerCode", "deviceTypeId", "deviceNetworkType"}, nil),
 		prometheus.GaugeValue,
 		1,
-		device.DeviceID, device.ManufacturerName, device.DeviceManufacturerCode, device.DeviceTypeID, device.DeviceNetworkType); err == nil {
+		account, device.DeviceID, device.ManufacturerName, device.DeviceManufacturerCode, device.DeviceTypeID, device.DeviceNetworkType); err == nil {
 
 		metrics <- m
 	}
 }
 
-func registerComponentMetrics(deviceId string, componentStatus smartthings.ComponentStatus, metrics chan<- prometheus.Metric) {
+func registerComponentMetrics(account, deviceId string, componentStatus smartthings.ComponentStatus, metrics chan<- prometheus.Metric) {
 	for componentId, attributes := range componentStatus {
 		for attributeId, properties := range attributes {
-			labels := []string{"deviceId", "componentId"}
-			values := []string{deviceId, componentId}
+			labels := []string{"account", "deviceId", "componentId"}
+			values := []string{account, deviceId, componentId}
 
 			var extras map[string]string
 			metricValue := float64(0)
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/setheck/smartthings-exporter/smartthings/smartthingstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectorAccounts(t *testing.T) {
+	home := &fakeClient{
+		devices: []*smartthings.Device{
+			{DeviceID: "dev-1", Label: "front door", Components: []*smartthings.Component{{ID: "main"}}},
+			{DeviceID: "dev-2", Label: "garage"},
+		},
+		statuses: map[string]smartthings.ComponentStatus{
+			"dev-1/main": {"switch": {"switch": {"value": "on"}}},
+		},
+	}
+	collector := NewCollector(
+		NewPoller("home", home, "", DeviceFilter{Exclude: []string{"Garage"}}, 0),
+		NewPoller("broken", &fakeClient{err: errors.New("unauthorized")}, "", DeviceFilter{}, 0),
+	)
+
+	expected := `
+# HELP smartthings_attribute_switch 
+# TYPE smartthings_attribute_switch gauge
+smartthings_attribute_switch{account="home",componentId="switch",deviceId="dev-1"} 1
+# HELP smartthings_device a registered device
+# TYPE smartthings_device gauge
+smartthings_device{account="home",deviceId="dev-1",deviceLabel="front door",name=""} 1
+# HELP smartthings_up whether the last request to the smartthings api succeeded
+# TYPE smartthings_up gauge
+smartthings_up{account="broken"} 0
+smartthings_up{account="home"} 1
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"smartthings_up", "smartthings_device", "smartthings_attribute_switch")
+	assert.NoError(t, err)
+}
+
+func TestDeviceFilter(t *testing.T) {
+	device := &smartthings.Device{DeviceID: "dev-1", Label: "Front Door", Name: "lock"}
+
+	tests := []struct {
+		name   string
+		filter DeviceFilter
+		want   bool
+	}{
+		{"empty filter", DeviceFilter{}, true},
+		{"include by id", DeviceFilter{Include: []string{"dev-1"}}, true},
+		{"include by label", DeviceFilter{Include: []string{"front door"}}, true},
+		{"include other", DeviceFilter{Include: []string{"dev-2"}}, false},
+		{"exclude by name", DeviceFilter{Exclude: []string{"LOCK"}}, false},
+		{"exclude wins", DeviceFilter{Include: []string{"dev-1"}, Exclude: []string{"dev-1"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, test.filter.Match(device))
+		})
+	}
+}
+
+func TestPollerSubscribe(t *testing.T) {
+	client := &fakeClient{
+		devices: []*smartthings.Device{{DeviceID: "dev-1", Components: []*smartthings.Component{{ID: "main"}}}},
+		statuses: map[string]smartthings.ComponentStatus{
+			"dev-1/main": {"switch": {"switch": {"value": "off"}}},
+		},
+	}
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Minute)
+	var snapshots []*Snapshot
+	poller.Subscribe(func(snapshot *Snapshot) { snapshots = append(snapshots, snapshot) })
+
+	polled, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Same(t, polled, snapshots[0])
+
+	assert.True(t, poller.ApplyEvent(&smartthings.DeviceEvent{DeviceID: "dev-1", ComponentID: "main", Capability: "switch", Attribute: "switch", Value: "on"}))
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "on", snapshots[1].Status["dev-1"]["main"]["switch"]["switch"]["value"])
+
+	// failed polls and unknown devices don't notify
+	client.err = errors.New("unavailable")
+	_, err = poller.Poll(context.Background())
+	assert.Error(t, err)
+	assert.False(t, poller.ApplyEvent(&smartthings.DeviceEvent{DeviceID: "dev-2"}))
+	assert.Len(t, snapshots, 2)
+}
+
+func TestCollectorKeepsLastSnapshot(t *testing.T) {
+	client := &fakeClient{
+		devices: []*smartthings.Device{{DeviceID: "dev-1", Components: []*smartthings.Component{{ID: "main"}}}},
+		statuses: map[string]smartthings.ComponentStatus{
+			"dev-1/main": {"switch": {"switch": {"value": "on"}}},
+		},
+	}
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Minute)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+
+	client.err = errors.New("unavailable")
+	_, err = poller.Poll(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, client.err, poller.Status().Error)
+
+	expected := `
+# HELP smartthings_attribute_switch 
+# TYPE smartthings_attribute_switch gauge
+smartthings_attribute_switch{account="home",componentId="switch",deviceId="dev-1"} 1
+# HELP smartthings_up whether the last request to the smartthings api succeeded
+# TYPE smartthings_up gauge
+smartthings_up{account="home"} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(NewCollector(poller), strings.NewReader(expected),
+		"smartthings_up", "smartthings_attribute_switch"))
+}
+
+func TestCollectorFakeServer(t *testing.T) {
+	server := smartthingstest.NewServer(&smartthingstest.Fixture{
+		Devices: []*smartthings.Device{
+			{DeviceID: "dev-1", Label: "porch light", Components: []*smartthings.Component{{ID: "main"}}},
+			{DeviceID: "dev-2", Label: "back door", Components: []*smartthings.Component{{ID: "main"}}},
+		},
+		Status: map[string]map[string]smartthings.ComponentStatus{
+			"dev-1": {"main": {"switch": {"switch": {"value": "on"}}}},
+			"dev-2": {"main": {"contactSensor": {"contact": {"value": "open"}}}},
+		},
+	})
+	defer server.Close()
+	server.SetPageSize(1)
+
+	poller := NewPoller("home", NewLimitedClient(server.Client(), 0), "", DeviceFilter{}, 0)
+	collector := NewCollector(poller)
+
+	expected := `
+# HELP smartthings_attribute_contact 
+# TYPE smartthings_attribute_contact gauge
+smartthings_attribute_contact{account="home",componentId="contactSensor",deviceId="dev-2",state="open"} 0
+# HELP smartthings_attribute_switch 
+# TYPE smartthings_attribute_switch gauge
+smartthings_attribute_switch{account="home",componentId="switch",deviceId="dev-1"} 1
+# HELP smartthings_up whether the last request to the smartthings api succeeded
+# TYPE smartthings_up gauge
+smartthings_up{account="home"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"smartthings_up", "smartthings_attribute_switch", "smartthings_attribute_contact"))
+
+	server.Throttle(1, time.Second)
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP smartthings_up whether the last request to the smartthings api succeeded
+# TYPE smartthings_up gauge
+smartthings_up{account="home"} 0
+`), "smartthings_up"))
+}
+
+func TestCollectorReplay(t *testing.T) {
+	cassette, err := smartthings.LoadCassette("testdata/home.cassette.json")
+	require.NoError(t, err)
+
+	client := smartthings.NewClient("replayed", &http.Client{Transport: smartthings.NewReplayer(cassette)})
+	client.SetBaseURL("http://replay.invalid/v1")
+	collector := NewCollector(NewPoller("home", client, "", DeviceFilter{}, 0))
+
+	expected := `
+# HELP smartthings_attribute_contact 
+# TYPE smartthings_attribute_contact gauge
+smartthings_attribute_contact{account="home",componentId="contactSensor",deviceId="dev-2",state="closed"} 1
+# HELP smartthings_attribute_switch 
+# TYPE smartthings_attribute_switch gauge
+smartthings_attribute_switch{account="home",componentId="switch",deviceId="dev-1"} 1
+`
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+			"smartthings_attribute_switch", "smartthings_attribute_contact"))
+	}
+}
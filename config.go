@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultAccount = "default"
+
+// Configuration is read from the optional yaml config file and the
+// environment with the STE prefix, environment variables override the file.
+type Configuration struct {
+	Port                int              `envconfig:"PORT" default:"9119" yaml:"port"`
+	ListenAddress       string           `envconfig:"LISTEN_ADDRESS" yaml:"listen_address"`
+	WebConfigFile       string           `envconfig:"WEB_CONFIG_FILE" yaml:"web_config_file"`
+	ReadTimeout         time.Duration    `envconfig:"READ_TIMEOUT" default:"10s" yaml:"read_timeout"`
+	WriteTimeout        time.Duration    `envconfig:"WRITE_TIMEOUT" default:"60s" yaml:"write_timeout"`
+	IdleTimeout         time.Duration    `envconfig:"IDLE_TIMEOUT" default:"120s" yaml:"idle_timeout"`
+	ShutdownGracePeriod time.Duration    `envconfig:"SHUTDOWN_GRACE_PERIOD" default:"30s" yaml:"shutdown_grace_period"`
+	ReadinessStaleness  time.Duration    `envconfig:"READINESS_STALENESS" yaml:"readiness_staleness"`
+	DebugAPI            bool             `envconfig:"DEBUG_API" yaml:"debug_api"`
+	LogLevel            string           `envconfig:"LOG_LEVEL" default:"info" yaml:"log_level"`
+	LogFormat           string           `envconfig:"LOG_FORMAT" default:"text" yaml:"log_format"`
+	ApiToken            string           `envconfig:"API_TOKEN" yaml:"api_token"`
+	ApiTokenFile        string           `envconfig:"API_TOKEN_FILE" yaml:"api_token_file"`
+	Accounts            []string         `envconfig:"ACCOUNTS" yaml:"-"`
+	AccountConfigs      []*AccountConfig `ignored:"true" yaml:"accounts"`
+	PollInterval        time.Duration    `envconfig:"POLL_INTERVAL" yaml:"poll_interval"`
+	RateLimit           float64          `envconfig:"RATE_LIMIT" default:"5" yaml:"rate_limit"`
+	IncludeDevices      []string         `envconfig:"INCLUDE_DEVICES" yaml:"include_devices"`
+	ExcludeDevices      []string         `envconfig:"EXCLUDE_DEVICES" yaml:"exclude_devices"`
+	ReplayFile          string           `envconfig:"REPLAY_FILE" yaml:"replay_file"`
+	TextfileDirectory   string           `envconfig:"TEXTFILE_DIRECTORY" yaml:"textfile_directory"`
+	TextfileInterval    time.Duration    `envconfig:"TEXTFILE_INTERVAL" default:"60s" yaml:"textfile_interval"`
+
+	TokenFileInterval time.Duration `envconfig:"TOKEN_FILE_INTERVAL" default:"30s" yaml:"token_file_interval"`
+
+	PushInterval    time.Duration `envconfig:"PUSH_INTERVAL" default:"60s" yaml:"push_interval"`
+	PushgatewayURL  string        `envconfig:"PUSHGATEWAY_URL" yaml:"pushgateway_url"`
+	PushgatewayJob  string        `envconfig:"PUSHGATEWAY_JOB" default:"smartthings" yaml:"pushgateway_job"`
+	RemoteWriteURL  string        `envconfig:"REMOTE_WRITE_URL" yaml:"remote_write_url"`
+	PushUsername    string        `envconfig:"PUSH_USERNAME" yaml:"push_username"`
+	PushPassword    string        `envconfig:"PUSH_PASSWORD" yaml:"push_password"`
+	PushBearerToken string        `envconfig:"PUSH_BEARER_TOKEN" yaml:"push_bearer_token"`
+
+	OTLPEndpoint string            `envconfig:"OTLP_ENDPOINT" yaml:"otlp_endpoint"`
+	OTLPProtocol string            `envconfig:"OTLP_PROTOCOL" default:"http/protobuf" yaml:"otlp_protocol"`
+	OTLPHeaders  map[string]string `envconfig:"OTLP_HEADERS" yaml:"otlp_headers"`
+	OTLPInterval time.Duration     `envconfig:"OTLP_INTERVAL" default:"60s" yaml:"otlp_interval"`
+
+	InfluxURL           string        `envconfig:"INFLUXDB_URL" yaml:"influxdb_url"`
+	InfluxOrg           string        `envconfig:"INFLUXDB_ORG" yaml:"influxdb_org"`
+	InfluxBucket        string        `envconfig:"INFLUXDB_BUCKET" yaml:"influxdb_bucket"`
+	InfluxToken         string        `envconfig:"INFLUXDB_TOKEN" yaml:"influxdb_token"`
+	InfluxBatchSize     int           `envconfig:"INFLUXDB_BATCH_SIZE" default:"5000" yaml:"influxdb_batch_size"`
+	InfluxFlushInterval time.Duration `envconfig:"INFLUXDB_FLUSH_INTERVAL" default:"10s" yaml:"influxdb_flush_interval"`
+
+	MQTTBroker          string `envconfig:"MQTT_BROKER" yaml:"mqtt_broker"`
+	MQTTClientID        string `envconfig:"MQTT_CLIENT_ID" default:"smartthings-exporter" yaml:"mqtt_client_id"`
+	MQTTUsername        string `envconfig:"MQTT_USERNAME" yaml:"mqtt_username"`
+	MQTTPassword        string `envconfig:"MQTT_PASSWORD" yaml:"mqtt_password"`
+	MQTTTopicPrefix     string `envconfig:"MQTT_TOPIC_PREFIX" default:"smartthings" yaml:"mqtt_topic_prefix"`
+	MQTTDiscovery       bool   `envconfig:"MQTT_DISCOVERY" yaml:"mqtt_discovery"`
+	MQTTDiscoveryPrefix string `envconfig:"MQTT_DISCOVERY_PREFIX" default:"homeassistant" yaml:"mqtt_discovery_prefix"`
+
+	Simulate        bool   `envconfig:"SIMULATE" yaml:"simulate"`
+	SimulateHomes   int    `envconfig:"SIMULATE_HOMES" default:"1" yaml:"simulate_homes"`
+	SimulateRooms   int    `envconfig:"SIMULATE_ROOMS" default:"4" yaml:"simulate_rooms"`
+	SimulateDevices int    `envconfig:"SIMULATE_DEVICES" default:"5" yaml:"simulate_devices"`
+	SimulateSeed    uint64 `envconfig:"SIMULATE_SEED" yaml:"simulate_seed"`
+
+	OAuthClientID     string   `envconfig:"OAUTH_CLIENT_ID" yaml:"oauth_client_id"`
+	OAuthClientSecret string   `envconfig:"OAUTH_CLIENT_SECRET" yaml:"oauth_client_secret"`
+	OAuthRedirectURL  string   `envconfig:"OAUTH_REDIRECT_URL" default:"http://localhost:9119/oauth/callback" yaml:"oauth_redirect_url"`
+	OAuthScopes       []string `envconfig:"OAUTH_SCOPES" default:"r:devices:*,r:locations:*" yaml:"oauth_scopes"`
+	OAuthTokenDir     string   `envconfig:"OAUTH_TOKEN_DIR" default:"." yaml:"oauth_token_dir"`
+
+	Webhook                  bool          `envconfig:"WEBHOOK" yaml:"webhook"`
+	WebhookReconcileInterval time.Duration `envconfig:"WEBHOOK_RECONCILE_INTERVAL" default:"15m" yaml:"webhook_reconcile_interval"`
+	WebhookVerifySignatures  bool          `envconfig:"WEBHOOK_VERIFY_SIGNATURES" default:"true" yaml:"webhook_verify_signatures"`
+}
+
+// AccountConfig is a named smartthings account, read from the accounts of
+// the config file and the environment with the STE_ACCOUNT_<NAME> prefix.
+// Unset values fall back to the top level configuration.
+type AccountConfig struct {
+	Name           string         `ignored:"true" yaml:"name"`
+	ApiToken       string         `envconfig:"API_TOKEN" yaml:"api_token"`
+	ApiTokenFile   string         `envconfig:"API_TOKEN_FILE" yaml:"api_token_file"`
+	Location       string         `envconfig:"LOCATION" yaml:"location"`
+	PollInterval   *time.Duration `envconfig:"POLL_INTERVAL" yaml:"poll_interval"`
+	RateLimit      *float64       `envconfig:"RATE_LIMIT" yaml:"rate_limit"`
+	IncludeDevices []string       `envconfig:"INCLUDE_DEVICES" yaml:"include_devices"`
+	ExcludeDevices []string       `envconfig:"EXCLUDE_DEVICES" yaml:"exclude_devices"`
+
+	OAuthClientID     string `envconfig:"OAUTH_CLIENT_ID" yaml:"oauth_client_id"`
+	OAuthClientSecret string `envconfig:"OAUTH_CLIENT_SECRET" yaml:"oauth_client_secret"`
+	OAuthTokenFile    string `envconfig:"OAUTH_TOKEN_FILE" yaml:"oauth_token_file"`
+}
+
+func (account *AccountConfig) Filter() DeviceFilter {
+	return DeviceFilter{Include: account.IncludeDevices, Exclude: account.ExcludeDevices}
+}
+
+// loadConfiguration reads the config file at path, when not empty, and the
+// environment on top of it, overrides are applied last. STE_ACCOUNTS selects
+// the accounts, otherwise the accounts of the file are used, and without
+// either a single default account is built from the top level values.
+func loadConfiguration(prefix, path string, overrides ...func(config *Configuration)) (*Configuration, []*AccountConfig, error) {
+	var env Configuration
+	if err := envconfig.Process(prefix, &env); err != nil {
+		return nil, nil, err
+	}
+
+	config := env
+	if path != "" {
+		if err := readConfigFile(path, &config); err != nil {
+			return nil, nil, err
+		}
+		// the defaults of env replaced the unset values, only set variables override the file
+		overrideFromEnv(prefix, &config, &env)
+	}
+	for _, override := range overrides {
+		override(&config)
+	}
+
+	fileAccounts := make(map[string]*AccountConfig)
+	for _, account := range config.AccountConfigs {
+		fileAccounts[account.Name] = account
+	}
+
+	accounts := config.AccountConfigs
+	if len(config.Accounts) > 0 {
+		accounts = nil
+		for _, name := range config.Accounts {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			account, ok := fileAccounts[name]
+			if !ok {
+				account = &AccountConfig{Name: name}
+			}
+			accounts = append(accounts, account)
+		}
+	}
+	if len(accounts) == 0 {
+		accounts = append(accounts, &AccountConfig{Name: defaultAccount})
+	}
+
+	for _, account := range accounts {
+		if account.Name == "" {
+			continue
+		}
+		// account variables have no defaults, unset ones leave the file values alone
+		if err := envconfig.Process(accountPrefix(prefix, account.Name), account); err != nil {
+			return nil, nil, fmt.Errorf("account %s: %w", account.Name, err)
+		}
+	}
+
+	if err := config.validate(accounts); err != nil {
+		if path != "" {
+			return nil, nil, fmt.Errorf("invalid configuration %s:\n%w", path, err)
+		}
+		return nil, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	for _, account := range accounts {
+		account.applyDefaults(&config)
+	}
+	config.AccountConfigs = accounts
+
+	return &config, accounts, nil
+}
+
+// readConfigFile decodes the yaml file at path into config, unknown fields are rejected.
+func readConfigFile(path string, config *Configuration) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("invalid configuration %s:\n%s", path, yamlTypeNames.Replace(strings.Join(typeErr.Errors, "\n")))
+		}
+		return fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+	return nil
+}
+
+var yamlTypeNames = strings.NewReplacer(
+	" in type main.Configuration", "",
+	" in type main.AccountConfig", " in account",
+)
+
+// overrideFromEnv copies the fields of env to config whose environment variable is set.
+func overrideFromEnv(prefix string, config, env *Configuration) {
+	target, source := reflect.ValueOf(config).Elem(), reflect.ValueOf(env).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		key := target.Type().Field(i).Tag.Get("envconfig")
+		if key == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(prefix + "_" + key); ok {
+			target.Field(i).Set(source.Field(i))
+		}
+	}
+}
+
+// validate reports every invalid value at once, named like in the config file.
+func (config *Configuration) validate(accounts []*AccountConfig) error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, err := newLogger(io.Discard, config.LogLevel, config.LogFormat); err != nil {
+		invalid("%v", err)
+	}
+	if config.Port < 1 || config.Port > 65535 {
+		invalid("port: %d is not a valid port", config.Port)
+	}
+	for name, d := range map[string]time.Duration{
+		"read_timeout":          config.ReadTimeout,
+		"write_timeout":         config.WriteTimeout,
+		"idle_timeout":          config.IdleTimeout,
+		"shutdown_grace_period": config.ShutdownGracePeriod,
+		"readiness_staleness":   config.ReadinessStaleness,
+		"poll_interval":         config.PollInterval,
+	} {
+		if d < 0 {
+			invalid("%s: must not be negative, got %s", name, d)
+		}
+	}
+	if config.RateLimit < 0 {
+		invalid("rate_limit: must not be negative, got %g", config.RateLimit)
+	}
+	if config.TokenFileInterval <= 0 {
+		invalid("token_file_interval: must be positive, got %s", config.TokenFileInterval)
+	}
+	if config.Simulate {
+		for name, n := range map[string]int{
+			"simulate_homes":   config.SimulateHomes,
+			"simulate_rooms":   config.SimulateRooms,
+			"simulate_devices": config.SimulateDevices,
+		} {
+			if n < 1 {
+				invalid("%s: must be positive, got %d", name, n)
+			}
+		}
+		if config.ReplayFile != "" {
+			invalid("simulate: can't be combined with replay_file")
+		}
+	}
+	if config.TextfileDirectory != "" && config.TextfileInterval <= 0 {
+		invalid("textfile_interval: must be positive, got %s", config.TextfileInterval)
+	}
+	for name, value := range map[string]string{
+		"pushgateway_url":  config.PushgatewayURL,
+		"remote_write_url": config.RemoteWriteURL,
+		"otlp_endpoint":    config.OTLPEndpoint,
+		"influxdb_url":     config.InfluxURL,
+	} {
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("%s: %q is not an http or https url", name, value)
+		}
+	}
+	if config.PushgatewayURL != "" || config.RemoteWriteURL != "" {
+		if config.PushInterval <= 0 {
+			invalid("push_interval: must be positive, got %s", config.PushInterval)
+		}
+		if config.PushgatewayURL != "" && config.PushgatewayJob == "" {
+			invalid("pushgateway_job: is required")
+		}
+		if config.PushUsername != "" && config.PushBearerToken != "" {
+			invalid("push_username: can't be combined with push_bearer_token")
+		}
+	}
+	if config.OTLPEndpoint != "" {
+		if config.OTLPProtocol != otlpProtocolHTTP && config.OTLPProtocol != otlpProtocolGRPC {
+			invalid("otlp_protocol: must be %s or %s, got %q", otlpProtocolHTTP, otlpProtocolGRPC, config.OTLPProtocol)
+		}
+		if config.OTLPInterval <= 0 {
+			invalid("otlp_interval: must be positive, got %s", config.OTLPInterval)
+		}
+	}
+	if config.InfluxURL != "" {
+		if config.InfluxOrg == "" {
+			invalid("influxdb_org: is required")
+		}
+		if config.InfluxBucket == "" {
+			invalid("influxdb_bucket: is required")
+		}
+		if config.InfluxBatchSize <= 0 {
+			invalid("influxdb_batch_size: must be positive, got %d", config.InfluxBatchSize)
+		}
+		if config.InfluxFlushInterval <= 0 {
+			invalid("influxdb_flush_interval: must be positive, got %s", config.InfluxFlushInterval)
+		}
+	}
+	if config.MQTTBroker != "" {
+		if u, err := url.Parse(config.MQTTBroker); err != nil || !slices.Contains(mqttSchemes, u.Scheme) || u.Host == "" {
+			invalid("mqtt_broker: %q is not a url with one of the schemes %s", config.MQTTBroker, strings.Join(mqttSchemes, ", "))
+		}
+		if config.MQTTClientID == "" {
+			invalid("mqtt_client_id: is required")
+		}
+		for name, prefix := range map[string]string{"mqtt_topic_prefix": config.MQTTTopicPrefix, "mqtt_discovery_prefix": config.MQTTDiscoveryPrefix} {
+			if prefix == "" || strings.ContainsAny(prefix, "+#") {
+				invalid("%s: %q is not a valid topic", name, prefix)
+			}
+		}
+	}
+	if config.Webhook && config.WebhookReconcileInterval <= 0 {
+		invalid("webhook_reconcile_interval: must be positive while the webhook is enabled, got %s", config.WebhookReconcileInterval)
+	}
+
+	seen := make(map[string]bool)
+	for i, account := range accounts {
+		field := fmt.Sprintf("accounts[%d]", i)
+		if account.Name == "" {
+			invalid("%s.name: is required", field)
+			continue
+		}
+		if seen[account.Name] {
+			invalid("account %s: configured more than once", account.Name)
+		}
+		seen[account.Name] = true
+
+		if account.PollInterval != nil && *account.PollInterval < 0 {
+			invalid("account %s: poll_interval: must not be negative, got %s", account.Name, *account.PollInterval)
+		}
+		if account.RateLimit != nil && *account.RateLimit < 0 {
+			invalid("account %s: rate_limit: must not be negative, got %g", account.Name, *account.RateLimit)
+		}
+		// a replay or simulation never calls the api
+		if config.ReplayFile == "" && !config.Simulate && account.ApiToken == "" && account.ApiTokenFile == "" && account.OAuthClientID == "" &&
+			config.ApiToken == "" && config.ApiTokenFile == "" && config.OAuthClientID == "" {
+			invalid("account %s: one of api_token, api_token_file or oauth_client_id is required", account.Name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy of the configuration safe to print, secrets are
+// replaced.
+func (config *Configuration) redacted() *Configuration {
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "<redacted>"
+	}
+
+	copied := *config
+	copied.ApiToken = redact(config.ApiToken)
+	copied.OAuthClientSecret = redact(config.OAuthClientSecret)
+	copied.PushPassword = redact(config.PushPassword)
+	copied.PushBearerToken = redact(config.PushBearerToken)
+	copied.InfluxToken = redact(config.InfluxToken)
+	copied.MQTTPassword = redact(config.MQTTPassword)
+	// headers usually carry the credentials of the collector
+	copied.OTLPHeaders = nil
+	for name, value := range config.OTLPHeaders {
+		if copied.OTLPHeaders == nil {
+			copied.OTLPHeaders = make(map[string]string)
+		}
+		copied.OTLPHeaders[name] = redact(value)
+	}
+	copied.AccountConfigs = nil
+	for _, account := range config.AccountConfigs {
+		account := *account
+		account.ApiToken = redact(account.ApiToken)
+		account.OAuthClientSecret = redact(account.OAuthClientSecret)
+		copied.AccountConfigs = append(copied.AccountConfigs, &account)
+	}
+	return &copied
+}
+
+// printConfiguration writes the effective configuration as yaml, without secrets.
+func printConfiguration(w io.Writer, config *Configuration) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config.redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func (account *AccountConfig) applyDefaults(config *Configuration) {
+	// an account with its own oauth2 app doesn't fall back to the shared token
+	if account.ApiToken == "" && account.ApiTokenFile == "" && account.OAuthClientID == "" {
+		account.ApiToken = config.ApiToken
+		account.ApiTokenFile = config.ApiTokenFile
+	}
+	if account.PollInterval == nil {
+		account.PollInterval = &config.PollInterval
+	}
+	if account.RateLimit == nil {
+		account.RateLimit = &config.RateLimit
+	}
+	if account.IncludeDevices == nil {
+		account.IncludeDevices = config.IncludeDevices
+	}
+	if account.ExcludeDevices == nil {
+		account.ExcludeDevices = config.ExcludeDevices
+	}
+	if account.OAuthClientID == "" {
+		account.OAuthClientID = config.OAuthClientID
+	}
+	if account.OAuthClientSecret == "" {
+		account.OAuthClientSecret = config.OAuthClientSecret
+	}
+	if account.OAuthTokenFile == "" {
+		account.OAuthTokenFile = filepath.Join(config.OAuthTokenDir, account.Name+".token.json")
+	}
+}
+
+// OAuth reports whether the account authenticates as an oauth2 app
+// instead of with an api token.
+func (account *AccountConfig) OAuth() bool {
+	return account.OAuthClientID != "" && account.ApiToken == "" && account.ApiTokenFile == ""
+}
+
+func accountPrefix(prefix, name string) string {
+	name = strings.ToUpper(strings.NewReplacer("-", "_", ".", "_", " ", "_").Replace(name))
+	return fmt.Sprintf("%s_ACCOUNT_%s", prefix, name)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadConfigurationAccounts(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "shared-token")
+	t.Setenv("TEST_POLL_INTERVAL", "30s")
+	t.Setenv("TEST_EXCLUDE_DEVICES", "garage")
+	t.Setenv("TEST_ACCOUNTS", "home, beach-house")
+	t.Setenv("TEST_ACCOUNT_HOME_LOCATION", "Home")
+	t.Setenv("TEST_ACCOUNT_BEACH_HOUSE_API_TOKEN", "beach-token")
+	t.Setenv("TEST_ACCOUNT_BEACH_HOUSE_POLL_INTERVAL", "5m")
+	t.Setenv("TEST_ACCOUNT_BEACH_HOUSE_RATE_LIMIT", "0")
+
+	_, accounts, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	require.Len(t, accounts, 2)
+
+	home, beach := accounts[0], accounts[1]
+	assert.Equal(t, "home", home.Name)
+	assert.Equal(t, "shared-token", home.ApiToken)
+	assert.Equal(t, "Home", home.Location)
+	assert.Equal(t, 30*time.Second, *home.PollInterval)
+	assert.Equal(t, float64(5), *home.RateLimit)
+	assert.Equal(t, []string{"garage"}, home.ExcludeDevices)
+
+	assert.Equal(t, "beach-house", beach.Name)
+	assert.Equal(t, "beach-token", beach.ApiToken)
+	assert.Equal(t, 5*time.Minute, *beach.PollInterval)
+	assert.Equal(t, float64(0), *beach.RateLimit)
+}
+
+func TestLoadConfigurationOAuthAccount(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "shared-token")
+	t.Setenv("TEST_ACCOUNTS", "home,cabin")
+	t.Setenv("TEST_ACCOUNT_CABIN_OAUTH_CLIENT_ID", "client-id")
+	t.Setenv("TEST_ACCOUNT_CABIN_OAUTH_CLIENT_SECRET", "client-secret")
+
+	_, accounts, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	require.Len(t, accounts, 2)
+
+	home, cabin := accounts[0], accounts[1]
+	assert.Equal(t, "shared-token", home.ApiToken)
+	assert.False(t, home.OAuth())
+	assert.Empty(t, cabin.ApiToken)
+	assert.True(t, cabin.OAuth(), "the shared token isn't used instead of the oauth2 app")
+}
+
+func TestLoadConfigurationDefaultAccount(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "token")
+
+	_, accounts, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	require.Len(t, accounts, 1)
+	assert.Equal(t, defaultAccount, accounts[0].Name)
+	assert.Equal(t, "token", accounts[0].ApiToken)
+	assert.Equal(t, time.Duration(0), *accounts[0].PollInterval)
+}
+
+func TestLoadConfigurationReplayWithoutToken(t *testing.T) {
+	_, _, err := loadConfiguration("TEST", "")
+	assert.ErrorContains(t, err, "api_token")
+
+	t.Setenv("TEST_REPLAY_FILE", "snapshot.json")
+	config, _, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot.json", config.ReplayFile)
+}
+
+func TestLoadConfigurationSimulate(t *testing.T) {
+	t.Setenv("TEST_SIMULATE", "true")
+	config, _, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	assert.Equal(t, 4, config.SimulateRooms)
+
+	t.Setenv("TEST_SIMULATE_HOMES", "0")
+	t.Setenv("TEST_REPLAY_FILE", "snapshot.json")
+	_, _, err = loadConfiguration("TEST", "")
+	assert.ErrorContains(t, err, "simulate_homes: must be positive, got 0")
+	assert.ErrorContains(t, err, "simulate: can't be combined with replay_file")
+}
+
+func TestLoadConfigurationPush(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "token")
+	t.Setenv("TEST_REMOTE_WRITE_URL", "http://prometheus:9090/api/v1/write")
+	config, _, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, config.PushInterval)
+
+	t.Setenv("TEST_PUSHGATEWAY_URL", "pushgateway:9091")
+	t.Setenv("TEST_PUSH_USERNAME", "user")
+	t.Setenv("TEST_PUSH_BEARER_TOKEN", "token")
+	_, _, err = loadConfiguration("TEST", "")
+	assert.ErrorContains(t, err, `pushgateway_url: "pushgateway:9091" is not an http or https url`)
+	assert.ErrorContains(t, err, "push_username: can't be combined with push_bearer_token")
+	assert.False(t, strings.Contains(err.Error(), "remote_write_url"))
+}
+
+func TestLoadConfigurationOTLP(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "token")
+	t.Setenv("TEST_OTLP_ENDPOINT", "http://localhost:4318")
+	t.Setenv("TEST_OTLP_HEADERS", "authorization:Bearer otlp-secret")
+	config, _, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	assert.Equal(t, otlpProtocolHTTP, config.OTLPProtocol)
+	assert.Equal(t, map[string]string{"authorization": "Bearer otlp-secret"}, config.OTLPHeaders)
+
+	var out strings.Builder
+	require.NoError(t, printConfiguration(&out, config))
+	assert.NotContains(t, out.String(), "otlp-secret")
+
+	t.Setenv("TEST_OTLP_PROTOCOL", "http/json")
+	_, _, err = loadConfiguration("TEST", "")
+	assert.ErrorContains(t, err, `otlp_protocol: must be http/protobuf or grpc, got "http/json"`)
+}
+
+func TestLoadConfigurationInfluxDB(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "token")
+	t.Setenv("TEST_INFLUXDB_URL", "http://influxdb:8086")
+	t.Setenv("TEST_INFLUXDB_ORG", "home")
+	t.Setenv("TEST_INFLUXDB_BUCKET", "smartthings")
+	t.Setenv("TEST_INFLUXDB_TOKEN", "influx-secret")
+	config, _, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	assert.Equal(t, 5000, config.InfluxBatchSize)
+	assert.Equal(t, 10*time.Second, config.InfluxFlushInterval)
+
+	var out strings.Builder
+	require.NoError(t, printConfiguration(&out, config))
+	assert.NotContains(t, out.String(), "influx-secret")
+
+	t.Setenv("TEST_INFLUXDB_BUCKET", "")
+	t.Setenv("TEST_INFLUXDB_BATCH_SIZE", "0")
+	_, _, err = loadConfiguration("TEST", "")
+	assert.ErrorContains(t, err, "influxdb_bucket: is required")
+	assert.ErrorContains(t, err, "influxdb_batch_size: must be positive, got 0")
+}
+
+func TestLoadConfigurationMQTT(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "token")
+	t.Setenv("TEST_MQTT_BROKER", "tcp://mosquitto:1883")
+	t.Setenv("TEST_MQTT_PASSWORD", "mqtt-secret")
+	config, _, err := loadConfiguration("TEST", "")
+	require.NoError(t, err)
+	assert.Equal(t, "smartthings", config.MQTTTopicPrefix)
+	assert.Equal(t, "homeassistant", config.MQTTDiscoveryPrefix)
+
+	var out strings.Builder
+	require.NoError(t, printConfiguration(&out, config))
+	assert.NotContains(t, out.String(), "mqtt-secret")
+
+	t.Setenv("TEST_MQTT_BROKER", "http://mosquitto:1883")
+	t.Setenv("TEST_MQTT_TOPIC_PREFIX", "smartthings/#")
+	_, _, err = loadConfiguration("TEST", "")
+	assert.ErrorContains(t, err, `mqtt_broker: "http://mosquitto:1883" is not a url with one of the schemes`)
+	assert.ErrorContains(t, err, `mqtt_topic_prefix: "smartthings/#" is not a valid topic`)
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigurationFile(t *testing.T) {
+	path := writeConfigFile(t, `
+port: 9200
+api_token: file-token
+poll_interval: 1m
+exclude_devices: [garage]
+accounts:
+  - name: home
+    location: Home
+  - name: beach-house
+    api_token: beach-token
+    rate_limit: 1
+`)
+	t.Setenv("TEST_PORT", "9300")
+	t.Setenv("TEST_ACCOUNT_HOME_POLL_INTERVAL", "5m")
+
+	config, accounts, err := loadConfiguration("TEST", path, func(config *Configuration) {
+		config.PollInterval = 2 * time.Minute
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 9300, config.Port, "environment overrides the file")
+	assert.Equal(t, 2*time.Minute, config.PollInterval, "overrides are applied last")
+	assert.Equal(t, 60*time.Second, config.WriteTimeout, "defaults are kept")
+	require.Len(t, accounts, 2)
+
+	home, beach := accounts[0], accounts[1]
+	assert.Equal(t, "file-token", home.ApiToken)
+	assert.Equal(t, "Home", home.Location)
+	assert.Equal(t, 5*time.Minute, *home.PollInterval)
+	assert.Equal(t, []string{"garage"}, home.ExcludeDevices)
+	assert.Equal(t, "beach-token", beach.ApiToken)
+	assert.Equal(t, 2*time.Minute, *beach.PollInterval)
+	assert.Equal(t, float64(1), *beach.RateLimit)
+
+	t.Setenv("TEST_ACCOUNTS", "beach-house")
+	_, accounts, err = loadConfiguration("TEST", path)
+	require.NoError(t, err)
+	require.Len(t, accounts, 1)
+	assert.Equal(t, "beach-token", accounts[0].ApiToken)
+}
+
+func TestLoadConfigurationFileErrors(t *testing.T) {
+	_, _, err := loadConfiguration("TEST", writeConfigFile(t, "api_token: token\nprot: 9119\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: field prot not found")
+	assert.NotContains(t, err.Error(), "main.Configuration")
+
+	_, _, err = loadConfiguration("TEST", writeConfigFile(t, "api_token: token\npoll_interval: often\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+
+	_, _, err = loadConfiguration("TEST", writeConfigFile(t, `
+port: 70000
+rate_limit: -1
+accounts:
+  - name: home
+  - location: Home
+  - name: home
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "port: 70000 is not a valid port")
+	assert.Contains(t, err.Error(), "rate_limit: must not be negative")
+	assert.Contains(t, err.Error(), "accounts[1].name: is required")
+	assert.Contains(t, err.Error(), "account home: configured more than once")
+	assert.Contains(t, err.Error(), "account home: one of api_token, api_token_file or oauth_client_id is required")
+
+	_, _, err = loadConfiguration("TEST", filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPrintConfiguration(t *testing.T) {
+	path := writeConfigFile(t, `
+api_token: secret-token
+push_password: push-secret
+accounts:
+  - name: home
+    oauth_client_id: client
+    oauth_client_secret: client-secret
+`)
+	config, _, err := loadConfiguration("TEST", path)
+	require.NoError(t, err)
+
+	var out strings.Builder
+	require.NoError(t, printConfiguration(&out, config))
+	assert.NotContains(t, out.String(), "secret-token")
+	assert.NotContains(t, out.String(), "client-secret")
+	assert.NotContains(t, out.String(), "push-secret")
+	assert.Contains(t, out.String(), "api_token: <redacted>")
+	assert.Contains(t, out.String(), "name: home")
+	assert.Contains(t, out.String(), "write_timeout: 1m0s")
+	assert.Equal(t, "secret-token", config.ApiToken, "the configuration itself is unchanged")
+
+	var printed Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(out.String()), &printed), "the output is a valid config file")
+}
@@ -3,7 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -45,3 +51,136 @@ func TestParseTime(t *testing.T) {
 	tm, _ := time.Parse(time.RFC3339Nano, ts)
 	fmt.Println(tm.UnixNano() / int64(time.Millisecond))
 }
+
+type fakeClient struct {
+	devices   []*smartthings.Device
+	locations []*smartthings.Location
+	rooms     []*smartthings.Room
+	statuses  map[string]smartthings.ComponentStatus
+	err       error
+}
+
+func (client *fakeClient) ListDevices(context.Context) ([]*smartthings.Device, error) {
+	return client.devices, client.err
+}
+
+func (client *fakeClient) ListLocations(context.Context, url.Values) ([]*smartthings.Location, error) {
+	return client.locations, client.err
+}
+
+func (client *fakeClient) ListRooms(_ context.Context, locationId string) ([]*smartthings.Room, error) {
+	var rooms []*smartthings.Room
+	for _, room := range client.rooms {
+		if room.LocationID == locationId {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, client.err
+}
+
+func (client *fakeClient) GetDeviceComponentStatus(_ context.Context, deviceId, componentId string) (smartthings.ComponentStatus, error) {
+	if client.err != nil {
+		return nil, client.err
+	}
+	return client.statuses[deviceId+"/"+componentId], nil
+}
+
+// fixtureClient is the account the sinks are tested with, a fridge plug in
+// the kitchen of home and a back door in the cabin.
+func fixtureClient() *fakeClient {
+	return &fakeClient{
+		locations: []*smartthings.Location{{ID: "loc-1", Name: "home"}, {ID: "loc-2", Name: "cabin"}},
+		rooms:     []*smartthings.Room{{ID: "room-1", LocationID: "loc-1", Name: "kitchen"}},
+		devices: []*smartthings.Device{
+			{DeviceID: "dev-1", Label: "fridge plug", LocationID: "loc-1", RoomID: "room-1", Components: []*smartthings.Component{{ID: "main"}}},
+			{DeviceID: "dev-2", Label: "back door", LocationID: "loc-2", Components: []*smartthings.Component{{ID: "main"}}},
+		},
+		statuses: map[string]smartthings.ComponentStatus{
+			"dev-1/main": {
+				"switch":                 {"switch": {"value": "on", "timestamp": "2023-11-14T22:10:00.250Z"}},
+				"energyMeter":            {"energy": {"value": 3.21, "unit": "kWh"}},
+				"temperatureMeasurement": {"temperature": {"value": 4.5, "unit": "C"}},
+			},
+			"dev-2/main": {"contactSensor": {"contact": {"value": "open"}}},
+		},
+	}
+}
+
+// snapshot is what a poll of the client at t returns.
+func (client *fakeClient) snapshot(account string, t time.Time) *Snapshot {
+	snapshot := &Snapshot{
+		Account:   account,
+		Time:      t,
+		Locations: client.locations,
+		Rooms:     client.rooms,
+		Devices:   client.devices,
+		Status:    make(map[string]map[string]smartthings.ComponentStatus),
+	}
+	for key, status := range client.statuses {
+		deviceId, componentId, _ := strings.Cut(key, "/")
+		if snapshot.Status[deviceId] == nil {
+			snapshot.Status[deviceId] = make(map[string]smartthings.ComponentStatus)
+		}
+		snapshot.Status[deviceId][componentId] = status
+	}
+	return snapshot
+}
+
+type recordedRequest struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// httpRecorder is a stand-in of the servers the sinks send to, answering
+// with the statuses in turn and 200 after them.
+type httpRecorder struct {
+	URL string
+
+	mu       sync.Mutex
+	requests []*recordedRequest
+	statuses []int
+}
+
+func newHTTPRecorder(t *testing.T, statuses ...int) *httpRecorder {
+	recorder := &httpRecorder{statuses: statuses}
+	server := httptest.NewServer(recorder)
+	t.Cleanup(server.Close)
+	recorder.URL = server.URL
+	return recorder
+}
+
+func (recorder *httpRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.requests = append(recorder.requests, &recordedRequest{method: r.Method, path: r.URL.Path, query: r.URL.Query(), header: r.Header, body: body})
+
+	status := http.StatusOK
+	if len(recorder.statuses) > 0 {
+		status, recorder.statuses = recorder.statuses[0], recorder.statuses[1:]
+	}
+	if status/100 != 2 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// recorded returns the requests received so far and forgets them.
+func (recorder *httpRecorder) recorded() []*recordedRequest {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	requests := recorder.requests
+	recorder.requests = nil
+	return requests
+}
+
+// respond sets the statuses of the next requests.
+func (recorder *httpRecorder) respond(statuses ...int) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.statuses = statuses
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"github.com/setheck/smartthings-exporter/smartthings/smartthingstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the device fixtures")
+
+// TestGoldenDevices collects the metrics of every device fixture in
+// testdata/devices and compares them to the .prom golden file next to it.
+// Run with -update to write the golden files after adding a fixture or
+// changing the metrics, and review the diff.
+func TestGoldenDevices(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/devices/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, fixtures)
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		t.Run(name, func(t *testing.T) {
+			server, err := smartthingstest.NewFixtureServer(fixture)
+			require.NoError(t, err)
+			defer server.Close()
+
+			collector := NewCollector(NewPoller("home", server.Client(), "", DeviceFilter{}, 0))
+			golden := strings.TrimSuffix(fixture, ".json") + ".prom"
+
+			if *update {
+				require.NoError(t, writeGolden(golden, collector))
+			}
+
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err, "run the test with -update to create the golden file")
+			assert.NoError(t, testutil.CollectAndCompare(collector, bytes.NewReader(expected)))
+		})
+	}
+}
+
+// writeGolden writes the text exposition of collector to path.
+func writeGolden(path string, collector prometheus.Collector) error {
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	var exposition bytes.Buffer
+	encoder := expfmt.NewEncoder(&exposition, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, exposition.Bytes(), 0644)
+}
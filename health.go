@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+
+	// without a configured staleness window a background poller is stale
+	// after missing this many polls
+	defaultStalePolls = 3
+)
+
+type HealthCheck struct {
+	Account string `json:"account,omitempty"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string         `json:"status"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+// LivenessHandler reports the process is alive, it doesn't depend on the api.
+type LivenessHandler struct{}
+
+func (LivenessHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, &HealthResponse{Status: healthOK, Checks: []*HealthCheck{}})
+}
+
+// ReadinessHandler reports ready unless the last successful refresh of an
+// account is older than the staleness window, or every account is failing.
+// A single failing account is only reported in its checks, as the others
+// are still exported.
+type ReadinessHandler struct {
+	pollers   []*Poller
+	staleness time.Duration
+}
+
+// NewReadinessHandler checks the pollers against staleness, a zero
+// staleness allows a background poller to miss a few polls.
+func NewReadinessHandler(staleness time.Duration, pollers ...*Poller) *ReadinessHandler {
+	return &ReadinessHandler{pollers: pollers, staleness: staleness}
+}
+
+func (handler *ReadinessHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	response := &HealthResponse{Status: healthOK, Checks: []*HealthCheck{}}
+	failing := 0
+	for _, poller := range handler.pollers {
+		for _, check := range handler.check(poller.Status()) {
+			switch {
+			case check.Status == healthOK:
+			case check.Name == "refresh":
+				failing++
+			case check.Name == "staleness":
+				response.Status = healthFail
+			}
+			response.Checks = append(response.Checks, check)
+		}
+	}
+	if failing > 0 && failing == len(handler.pollers) {
+		response.Status = healthFail
+	}
+
+	code := http.StatusOK
+	if response.Status != healthOK {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, response)
+}
+
+func (handler *ReadinessHandler) check(status PollerStatus) []*HealthCheck {
+	refresh := &HealthCheck{Account: status.Account, Name: "refresh", Status: healthOK}
+	switch {
+	case status.Error != nil:
+		refresh.Status, refresh.Error = healthFail, status.Error.Error()
+	case !status.Ready:
+		refresh.Status, refresh.Error = healthFail, errNotPolled.Error()
+	}
+
+	token := &HealthCheck{Account: status.Account, Name: "token", Status: healthOK}
+	if errors.Is(status.Error, smartthings.ErrUnauthorized) || errors.Is(status.Error, smartthings.ErrNotAuthorized) {
+		token.Status, token.Error = healthFail, status.Error.Error()
+	}
+
+	checks := []*HealthCheck{refresh, token}
+
+	// polling on scrape only refreshes when prometheus scrapes, so only
+	// background pollers can go stale
+	if status.Interval > 0 {
+		staleness := handler.staleness
+		if staleness <= 0 {
+			staleness = defaultStalePolls * status.Interval
+		}
+		stale := &HealthCheck{Account: status.Account, Name: "staleness", Status: healthOK}
+		if age := time.Since(status.LastSuccess); status.LastSuccess.IsZero() || age > staleness {
+			stale.Status = healthFail
+			stale.Error = fmt.Sprintf("last successful refresh is older than %s", staleness)
+			if !status.LastSuccess.IsZero() {
+				stale.Error = fmt.Sprintf("last successful refresh %s ago is older than %s", age.Round(time.Second), staleness)
+			}
+		}
+		checks = append(checks, stale)
+	}
+
+	return checks
+}
+
+func writeHealth(w http.ResponseWriter, code int, response *HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Warn("responding to health request failed", "error", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyClient fails until up is set.
+type flakyClient struct {
+	fakeClient
+	mu sync.Mutex
+	up bool
+}
+
+func (client *flakyClient) ListDevices(ctx context.Context) ([]*smartthings.Device, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if !client.up {
+		return nil, errors.New("connection refused")
+	}
+	return client.fakeClient.ListDevices(ctx)
+}
+
+func TestDegradedStartup(t *testing.T) {
+	initialBackoff = time.Millisecond
+	defer func() { initialBackoff = time.Second }()
+
+	client := &flakyClient{fakeClient: fakeClient{devices: []*smartthings.Device{{DeviceID: "dev-1"}}}}
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Hour)
+	readiness := NewReadinessHandler(0, poller)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go poller.Run(ctx)
+
+	rec := httptest.NewRecorder()
+	readiness.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NoError(t, testutil.CollectAndCompare(NewCollector(poller),
+		strings.NewReader("# HELP smartthings_up whether the last request to the smartthings api succeeded\n# TYPE smartthings_up gauge\nsmartthings_up{account=\"home\"} 0\n"),
+		"smartthings_up"))
+
+	client.mu.Lock()
+	client.up = true
+	client.mu.Unlock()
+	assert.Eventually(t, poller.Ready, time.Second, time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	readiness.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, testutil.CollectAndCompare(NewCollector(poller),
+		strings.NewReader("# HELP smartthings_up whether the last request to the smartthings api succeeded\n# TYPE smartthings_up gauge\nsmartthings_up{account=\"home\"} 1\n"),
+		"smartthings_up"))
+}
+
+func TestLiveness(t *testing.T) {
+	rec := httptest.NewRecorder()
+	LivenessHandler{}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok","checks":[]}`, rec.Body.String())
+}
+
+func readiness(t *testing.T, handler *ReadinessHandler) (int, map[string]*HealthCheck) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var response HealthResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	checks := make(map[string]*HealthCheck)
+	for _, check := range response.Checks {
+		checks[check.Account+"/"+check.Name] = check
+	}
+	return rec.Code, checks
+}
+
+func TestReadinessChecks(t *testing.T) {
+	client := &fakeClient{devices: []*smartthings.Device{{DeviceID: "dev-1"}}}
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Hour)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+
+	code, checks := readiness(t, NewReadinessHandler(0, poller))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOK, checks["home/refresh"].Status)
+	assert.Equal(t, healthOK, checks["home/token"].Status)
+	assert.Equal(t, healthOK, checks["home/staleness"].Status)
+
+	code, checks = readiness(t, NewReadinessHandler(time.Nanosecond, poller))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthOK, checks["home/refresh"].Status)
+	assert.Equal(t, healthFail, checks["home/staleness"].Status)
+
+	client.err = fmt.Errorf("failed request: %w", smartthings.ErrUnauthorized)
+	_, err = poller.Poll(context.Background())
+	require.Error(t, err)
+
+	code, checks = readiness(t, NewReadinessHandler(0, poller))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFail, checks["home/refresh"].Status)
+	assert.Equal(t, healthFail, checks["home/token"].Status)
+	assert.Contains(t, checks["home/token"].Error, "unauthorized")
+}
+
+func TestReadinessOnScrape(t *testing.T) {
+	poller := NewPoller("home", &fakeClient{}, "", DeviceFilter{}, 0)
+
+	code, checks := readiness(t, NewReadinessHandler(0, poller))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFail, checks["home/refresh"].Status)
+
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+
+	code, checks = readiness(t, NewReadinessHandler(time.Nanosecond, poller))
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, checks, "home/staleness")
+}
+
+func TestReadinessFailingAccount(t *testing.T) {
+	client := &fakeClient{devices: []*smartthings.Device{{DeviceID: "dev-1"}}}
+	home := NewPoller("home", client, "", DeviceFilter{}, time.Hour)
+	_, err := home.Poll(context.Background())
+	require.NoError(t, err)
+	cabin := NewPoller("cabin", &fakeClient{err: errors.New("connection refused")}, "", DeviceFilter{}, time.Hour)
+	_, err = cabin.Poll(context.Background())
+	require.Error(t, err)
+
+	code, checks := readiness(t, NewReadinessHandler(0, home, cabin))
+	assert.Equal(t, http.StatusServiceUnavailable, code, "cabin never succeeded")
+	assert.Equal(t, healthFail, checks["cabin/staleness"].Status)
+
+	// a failing account within the staleness window keeps the pod ready
+	cabin.client = client
+	_, err = cabin.Poll(context.Background())
+	require.NoError(t, err)
+	client.err = errors.New("connection refused")
+	_, err = cabin.Poll(context.Background())
+	require.Error(t, err)
+
+	code, checks = readiness(t, NewReadinessHandler(0, home, cabin))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOK, checks["home/refresh"].Status)
+	assert.Equal(t, healthFail, checks["cabin/refresh"].Status)
+	assert.Equal(t, healthOK, checks["cabin/staleness"].Status)
+
+	// unless every account is failing
+	_, err = home.Poll(context.Background())
+	require.Error(t, err)
+	code, _ = readiness(t, NewReadinessHandler(0, home, cabin))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
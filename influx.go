@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+// influxRetries is how often a failed batch is retried within a flush,
+// with a doubling backoff unless the server asks for a Retry-After.
+const influxRetries = 3
+
+var influxBackoff = time.Second
+
+// errInfluxRejected is a batch influxdb won't ever accept, like one with a
+// field type conflict or to a missing bucket.
+var errInfluxRejected = errors.New("influxdb rejected the batch")
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// InfluxConfig configures the writes to the /api/v2/write endpoint of
+// InfluxDB.
+type InfluxConfig struct {
+	URL           string
+	Org           string
+	Bucket        string
+	Token         string
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// InfluxWriter writes every snapshot of the pollers it's subscribed to as
+// line protocol. The lines are buffered and flushed in batches, unsent
+// lines are kept for the next flush up to 10 batches.
+type InfluxWriter struct {
+	config InfluxConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []string
+	// written is the latest timestamp and value of every field of every
+	// series
+	written map[string]influxValue
+}
+
+type influxValue struct {
+	millis int64
+	value  string
+}
+
+func NewInfluxWriter(config InfluxConfig, client *http.Client) *InfluxWriter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &InfluxWriter{config: config, client: client, written: make(map[string]influxValue)}
+}
+
+// Write buffers the fields of the snapshot that changed since they were
+// written before, it's meant for Poller.Subscribe. Every webhook event
+// notifies with the whole snapshot, of which only one attribute changed.
+func (writer *InfluxWriter) Write(snapshot *Snapshot) {
+	points := snapshotPoints(snapshot)
+
+	writer.mu.Lock()
+	lines := make([]string, 0, len(points))
+	for _, point := range points {
+		changed := make(map[string]string, len(point.fields))
+		for name, value := range point.fields {
+			key := point.series + " " + name
+			if written, ok := writer.written[key]; ok && (point.millis < written.millis || point.millis == written.millis && value == written.value) {
+				continue
+			}
+			writer.written[key] = influxValue{millis: point.millis, value: value}
+			changed[name] = value
+		}
+		if len(changed) > 0 {
+			point.fields = changed
+			lines = append(lines, point.String())
+		}
+	}
+	writer.mu.Unlock()
+
+	writer.enqueue(lines...)
+}
+
+func (writer *InfluxWriter) enqueue(lines ...string) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	writer.pending = append(writer.pending, lines...)
+	if limit := 10 * writer.config.BatchSize; len(writer.pending) > limit {
+		dropped := len(writer.pending) - limit
+		writer.pending = writer.pending[dropped:]
+		slog.Warn("influxdb is behind, dropped the oldest lines", "lines", dropped)
+	}
+}
+
+// Run flushes every flush interval until ctx is done, and once more then.
+func (writer *InfluxWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(writer.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := writer.Flush(flushCtx); err != nil {
+				slog.Error("writing to influxdb failed", "error", err)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		if err := writer.Flush(ctx); err != nil {
+			slog.Error("writing to influxdb failed", "error", err)
+		}
+	}
+}
+
+// Flush writes the buffered lines in batches. A rejected batch is dropped,
+// on other errors the lines of the failed batch and the ones after it are
+// buffered again.
+func (writer *InfluxWriter) Flush(ctx context.Context) error {
+	writer.mu.Lock()
+	lines := writer.pending
+	writer.pending = nil
+	writer.mu.Unlock()
+
+	var rejected error
+	for len(lines) > 0 {
+		batch := lines[:min(len(lines), writer.config.BatchSize)]
+		err := writer.writeBatch(ctx, batch)
+		if errors.Is(err, errInfluxRejected) {
+			slog.Error("influxdb rejected a batch, dropped it", "lines", len(batch), "error", err)
+			rejected = err
+		} else if err != nil {
+			writer.mu.Lock()
+			writer.pending = append(lines, writer.pending...)
+			writer.mu.Unlock()
+			// applies the buffer limit
+			writer.enqueue()
+			return err
+		}
+		lines = lines[len(batch):]
+	}
+	return rejected
+}
+
+func (writer *InfluxWriter) writeBatch(ctx context.Context, lines []string) error {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+
+	backoff := influxBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := writer.write(ctx, body)
+		if retryAfter < 0 {
+			return fmt.Errorf("%w: %v", errInfluxRejected, err)
+		}
+		if err == nil || attempt == influxRetries {
+			return err
+		}
+		if retryAfter == 0 {
+			retryAfter = backoff
+			backoff *= 2
+		}
+		slog.Warn("writing to influxdb failed, retrying", "backoff", retryAfter, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+// write sends a request, on failure it returns how long to wait before a
+// retry, 0 for the default backoff or -1 when a retry won't help.
+func (writer *InfluxWriter) write(ctx context.Context, body []byte) (time.Duration, error) {
+	u, err := url.Parse(writer.config.URL)
+	if err != nil {
+		return -1, err
+	}
+	u = u.JoinPath("/api/v2/write")
+	u.RawQuery = url.Values{
+		"org":       {writer.config.Org},
+		"bucket":    {writer.config.Bucket},
+		"precision": {"ms"},
+	}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "smartthings-exporter/"+Version)
+	if writer.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+writer.config.Token)
+	}
+
+	resp, err := writer.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return 0, nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("unexpected status code %d while writing to %s: %s", resp.StatusCode, u.Redacted(), bytes.TrimSpace(message))
+	if resp.StatusCode/100 != 5 && resp.StatusCode != http.StatusTooManyRequests {
+		return -1, err
+	}
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, err
+	}
+	return 0, err
+}
+
+// influxPoint is a line of line protocol, the series is the measurement
+// with its tags and the fields are escaped.
+type influxPoint struct {
+	series string
+	fields map[string]string
+	millis int64
+}
+
+func (point influxPoint) String() string {
+	fields := make([]string, 0, len(point.fields))
+	for _, name := range sortedKeys(point.fields) {
+		fields = append(fields, name+"="+point.fields[name])
+	}
+	return point.series + " " + strings.Join(fields, ",") + " " + strconv.FormatInt(point.millis, 10)
+}
+
+// snapshotPoints converts a snapshot to points, with a measurement per
+// capability tagged with the device, room and location. The attributes of
+// a capability are fields of a point per attribute timestamp, attributes
+// without one are at the time of the snapshot.
+func snapshotPoints(snapshot *Snapshot) []influxPoint {
+	var points []influxPoint
+	for _, device := range snapshot.Devices {
+		tags := map[string]string{
+			"account":   snapshot.Account,
+			"device_id": device.DeviceID,
+			"device":    device.Label,
+		}
+		if room := snapshot.Room(device.RoomID); room != nil {
+			tags["room"] = room.Name
+		}
+		if location := snapshot.Location(device.LocationID); location != nil {
+			tags["location"] = location.Name
+		}
+
+		status := snapshot.Status[device.DeviceID]
+		for _, componentId := range sortedKeys(status) {
+			tags["component"] = componentId
+			for _, capabilityId := range sortedKeys(status[componentId]) {
+				points = append(points, capabilityPoints(capabilityId, tags, status[componentId][capabilityId], snapshot.Time)...)
+			}
+		}
+	}
+	return points
+}
+
+func capabilityPoints(capabilityId string, tags map[string]string, attributes smartthings.ComponentAttributes, snapshotTime time.Time) []influxPoint {
+	fields := map[int64]map[string]string{}
+	for _, attributeId := range sortedKeys(attributes) {
+		properties := attributes[attributeId]
+		field, ok := influxField(properties["value"])
+		if !ok {
+			continue
+		}
+
+		timestamp := snapshotTime
+		if value, ok := properties["timestamp"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				timestamp = t
+			}
+		}
+		millis := timestamp.UnixMilli()
+		if fields[millis] == nil {
+			fields[millis] = make(map[string]string)
+		}
+		fields[millis][influxTagEscaper.Replace(attributeId)] = field
+	}
+
+	times := make([]int64, 0, len(fields))
+	for millis := range fields {
+		times = append(times, millis)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	var series strings.Builder
+	series.WriteString(influxMeasurementEscaper.Replace(capabilityId))
+	for _, name := range sortedKeys(tags) {
+		// influxdb rejects empty tag values
+		if tags[name] != "" {
+			series.WriteString("," + name + "=" + influxTagEscaper.Replace(tags[name]))
+		}
+	}
+
+	points := make([]influxPoint, 0, len(times))
+	for _, millis := range times {
+		points = append(points, influxPoint{series: series.String(), fields: fields[millis], millis: millis})
+	}
+	return points
+}
+
+// influxField formats an attribute value as a field value. Numbers are
+// floats, objects and lists are json strings.
+func influxField(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + influxStringEscaper.Replace(v) + `"`, true
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return `"` + influxStringEscaper.Replace(string(data)) + `"`, true
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
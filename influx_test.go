@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// influxSnapshotAt is the fixture polled d after 1700000000000, with the
+// same attribute timestamps.
+func influxSnapshotAt(d time.Duration) *Snapshot {
+	return fixtureClient().snapshot("home", time.UnixMilli(1700000000000).Add(d))
+}
+
+func snapshotLines(snapshot *Snapshot) []string {
+	var lines []string
+	for _, point := range snapshotPoints(snapshot) {
+		lines = append(lines, point.String())
+	}
+	return lines
+}
+
+func TestSnapshotLines(t *testing.T) {
+	assert.Equal(t, []string{
+		`energyMeter,account=home,component=main,device=fridge\ plug,device_id=dev-1,location=home,room=kitchen energy=3.21 1700000000000`,
+		`switch,account=home,component=main,device=fridge\ plug,device_id=dev-1,location=home,room=kitchen switch="on" 1699999800250`,
+		`temperatureMeasurement,account=home,component=main,device=fridge\ plug,device_id=dev-1,location=home,room=kitchen temperature=4.5 1700000000000`,
+		`contactSensor,account=home,component=main,device=back\ door,device_id=dev-2,location=cabin contact="open" 1700000000000`,
+	}, snapshotLines(influxSnapshotAt(0)))
+}
+
+func TestSnapshotLinesEscaping(t *testing.T) {
+	snapshot := &Snapshot{
+		Account:   "home",
+		Time:      time.UnixMilli(1700000000000),
+		Locations: []*smartthings.Location{{ID: "loc-1", Name: "My Home"}},
+		Rooms:     []*smartthings.Room{{ID: "room-1", LocationID: "loc-1", Name: "living,room"}},
+		Devices:   []*smartthings.Device{{DeviceID: "dev-1", Label: "hallway=sensor", LocationID: "loc-1", RoomID: "room-1"}},
+		Status: map[string]map[string]smartthings.ComponentStatus{
+			"dev-1": {"main": {
+				"motionSensor": {"motion": {"value": `say "hi"`}},
+				"battery": {
+					"battery":       {"value": float64(87)},
+					"lowBattery":    {"value": false},
+					"supportedList": {"value": []interface{}{"a", "b"}},
+					"status":        {"value": nil},
+				},
+			}},
+		},
+	}
+	assert.Equal(t, []string{
+		`battery,account=home,component=main,device=hallway\=sensor,device_id=dev-1,location=My\ Home,room=living\,room battery=87,lowBattery=false,supportedList="[\"a\",\"b\"]" 1700000000000`,
+		`motionSensor,account=home,component=main,device=hallway\=sensor,device_id=dev-1,location=My\ Home,room=living\,room motion="say \"hi\"" 1700000000000`,
+	}, snapshotLines(snapshot))
+}
+
+func TestSnapshotLinesTimestamps(t *testing.T) {
+	snapshot := &Snapshot{
+		Account: "home",
+		Time:    time.UnixMilli(1700000000000),
+		Devices: []*smartthings.Device{{DeviceID: "dev-1"}},
+		Status: map[string]map[string]smartthings.ComponentStatus{
+			"dev-1": {"main": {"thermostat": {
+				"heatingSetpoint": {"value": 21.0, "timestamp": "2023-11-14T22:00:00.000Z"},
+				"coolingSetpoint": {"value": 25.0, "timestamp": "2023-11-14T22:00:00.000Z"},
+				"mode":            {"value": "heat", "timestamp": "not a time"},
+			}}},
+		},
+	}
+	assert.Equal(t, []string{
+		`thermostat,account=home,component=main,device_id=dev-1 coolingSetpoint=25,heatingSetpoint=21 1699999200000`,
+		`thermostat,account=home,component=main,device_id=dev-1 mode="heat" 1700000000000`,
+	}, snapshotLines(snapshot))
+}
+
+func influxConfig(url string) InfluxConfig {
+	return InfluxConfig{URL: url, Org: "my org", Bucket: "smartthings", Token: "secret", BatchSize: 3, FlushInterval: time.Hour}
+}
+
+func TestInfluxWriterFlush(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	writer := NewInfluxWriter(influxConfig(recorder.URL), nil)
+	writer.Write(influxSnapshotAt(0))
+	require.NoError(t, writer.Flush(context.Background()))
+
+	requests := recorder.recorded()
+	require.Len(t, requests, 2, "4 lines are written in batches of 3")
+	request := requests[0]
+	assert.Equal(t, http.MethodPost, request.method)
+	assert.Equal(t, "/api/v2/write", request.path)
+	assert.Equal(t, "my org", request.query.Get("org"))
+	assert.Equal(t, "smartthings", request.query.Get("bucket"))
+	assert.Equal(t, "ms", request.query.Get("precision"))
+	assert.Equal(t, "Token secret", request.header.Get("Authorization"))
+	assert.Equal(t, 3, strings.Count(string(request.body), "\n"))
+	assert.True(t, strings.HasPrefix(string(requests[1].body), "contactSensor,"))
+
+	// nothing is left to write
+	require.NoError(t, writer.Flush(context.Background()))
+	assert.Empty(t, recorder.recorded())
+}
+
+func TestInfluxWriterRetries(t *testing.T) {
+	defer func(backoff time.Duration) { influxBackoff = backoff }(influxBackoff)
+	influxBackoff = time.Millisecond
+
+	recorder := newHTTPRecorder(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	config := influxConfig(recorder.URL)
+	config.BatchSize = 10
+	writer := NewInfluxWriter(config, nil)
+	writer.Write(influxSnapshotAt(0))
+	require.NoError(t, writer.Flush(context.Background()))
+	assert.Len(t, recorder.recorded(), 3)
+
+	// client errors aren't retried, the rejected batch is dropped and the
+	// next ones are still written
+	recorder.respond(http.StatusBadRequest)
+	writer.config.BatchSize = 1
+	writer.Write(influxSnapshotAt(time.Minute))
+	err := writer.Flush(context.Background())
+	assert.ErrorIs(t, err, errInfluxRejected)
+	assert.ErrorContains(t, err, "unexpected status code 400")
+	assert.Len(t, recorder.recorded(), 3)
+	assert.Empty(t, writer.pending)
+
+	// server errors keep the lines for the next flush
+	recorder.respond(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	writer.Write(influxSnapshotAt(2 * time.Minute))
+	assert.ErrorContains(t, writer.Flush(context.Background()), "unexpected status code 503")
+	assert.Len(t, writer.pending, 3)
+
+	require.NoError(t, writer.Flush(context.Background()))
+	requests := recorder.recorded()
+	require.Len(t, requests, 7)
+	assert.Equal(t, requests[0].body, requests[4].body)
+	assert.Empty(t, writer.pending)
+}
+
+func TestInfluxWriterBufferLimit(t *testing.T) {
+	config := influxConfig("http://influxdb.invalid")
+	config.BatchSize = 1
+	writer := NewInfluxWriter(config, nil)
+	for i := 0; i < 5; i++ {
+		writer.Write(influxSnapshotAt(time.Duration(i) * time.Minute))
+	}
+	assert.Len(t, writer.pending, 10)
+	assert.True(t, strings.HasPrefix(writer.pending[9], "contactSensor,"), "the oldest lines are dropped")
+}
+
+func TestInfluxWriterWritesChanges(t *testing.T) {
+	writer := NewInfluxWriter(influxConfig("http://influxdb.invalid"), nil)
+	poller := NewPoller("home", fixtureClient(), "", DeviceFilter{}, time.Minute)
+	poller.Subscribe(writer.Write)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+	polled := len(writer.pending)
+
+	// an event only writes the changed attribute
+	poller.ApplyEvent(&smartthings.DeviceEvent{DeviceID: "dev-2", ComponentID: "main", Capability: "contactSensor", Attribute: "contact", Value: "closed"})
+	require.Len(t, writer.pending, polled+1)
+	assert.Contains(t, writer.pending[polled], `contactSensor,account=home,component=main,device=back\ door,device_id=dev-2,location=cabin contact="closed" `)
+
+	// a snapshot is only written again when it's newer
+	snapshot, err := poller.Snapshot(context.Background())
+	require.NoError(t, err)
+	writer.Write(snapshot)
+	assert.Len(t, writer.pending, polled+1)
+}
+
+func TestInfluxWriterWritesChangedFields(t *testing.T) {
+	writer := NewInfluxWriter(influxConfig("http://influxdb.invalid"), nil)
+	snapshot := func(a, b string) *Snapshot {
+		return &Snapshot{
+			Account: "home",
+			Time:    time.UnixMilli(1700000000000),
+			Devices: []*smartthings.Device{{DeviceID: "dev-1"}},
+			Status: map[string]map[string]smartthings.ComponentStatus{
+				"dev-1": {"main": {"thermostat": {
+					"heatingSetpoint": {"value": 21.0, "timestamp": a},
+					"coolingSetpoint": {"value": 25.0, "timestamp": b},
+				}}},
+			},
+		}
+	}
+
+	writer.Write(snapshot("1970-01-01T00:00:00.100Z", "1970-01-01T00:00:00.200Z"))
+	assert.Equal(t, []string{
+		`thermostat,account=home,component=main,device_id=dev-1 heatingSetpoint=21 100`,
+		`thermostat,account=home,component=main,device_id=dev-1 coolingSetpoint=25 200`,
+	}, writer.pending)
+
+	// a field is written when it changed, even before the other fields
+	writer.pending = nil
+	writer.Write(snapshot("1970-01-01T00:00:00.150Z", "1970-01-01T00:00:00.200Z"))
+	assert.Equal(t, []string{`thermostat,account=home,component=main,device_id=dev-1 heatingSetpoint=21 150`}, writer.pending)
+}
+
+func TestInfluxWriterSubscribe(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	writer := NewInfluxWriter(influxConfig(recorder.URL), nil)
+	poller := NewPoller("home", fixtureClient(), "", DeviceFilter{}, time.Minute)
+	poller.Subscribe(writer.Write)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		writer.Run(ctx)
+		close(done)
+	}()
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+	cancel()
+	<-done
+
+	var body string
+	for _, request := range recorder.recorded() {
+		body += string(request.body)
+	}
+	assert.Contains(t, body, `energyMeter,account=home,component=main,device=fridge\ plug,device_id=dev-1,location=home,room=kitchen energy=3.21 `)
+	assert.Contains(t, body, `contactSensor,account=home,component=main,device=back\ door,device_id=dev-2,location=cabin contact="open" `)
+}
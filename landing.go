@@ -0,0 +1,201 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+var landingTemplate = template.Must(template.New("landing").Funcs(template.FuncMap{
+	"age": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>smartthings-exporter</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; vertical-align: top; }
+.error { color: #b00; }
+.ok { color: #080; }
+</style>
+</head>
+<body>
+<h1>smartthings-exporter</h1>
+<p>version {{.Version}}, built {{.Built}}, commit {{.Commit}}</p>
+<ul>
+{{range .Links}}<li><a href="{{.Path}}">{{.Path}}</a> {{.Description}}</li>
+{{end}}</ul>
+
+<h2>Accounts</h2>
+<table>
+<tr><th>account</th><th>poll interval</th><th>last poll</th><th>last success</th><th>status</th></tr>
+{{range .Accounts}}<tr>
+<td>{{.Account}}</td>
+<td>{{if .Interval}}{{.Interval}}{{else}}on scrape{{end}}</td>
+<td>{{age .LastPoll}}</td>
+<td>{{age .LastSuccess}}</td>
+<td>{{if .Error}}<span class="error">{{.Error}}</span>{{else if .Ready}}<span class="ok">ok</span>{{else}}initializing{{end}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Devices</h2>
+{{range .Accounts}}{{$account := .Account}}{{range .Locations}}
+<h3>{{$account}} / {{.Name}}</h3>
+<table>
+<tr><th>room</th><th>device</th><th>id</th><th>capabilities</th><th>last update</th></tr>
+{{range .Rooms}}{{$room := .Name}}{{range .Devices}}<tr>
+<td>{{$room}}</td>
+<td>{{.Label}}</td>
+<td>{{.ID}}</td>
+<td>{{range $i, $c := .Capabilities}}{{if $i}}, {{end}}{{$c}}{{end}}</td>
+<td>{{age .LastUpdate}}</td>
+</tr>
+{{end}}{{end}}</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+type landingLink struct {
+	Path        string
+	Description string
+}
+
+type landingAccount struct {
+	PollerStatus
+	Locations []*landingLocation
+}
+
+type landingLocation struct {
+	Name  string
+	Rooms []*landingRoom
+}
+
+type landingRoom struct {
+	Name    string
+	Devices []*landingDevice
+}
+
+type landingDevice struct {
+	ID           string
+	Label        string
+	Capabilities []string
+	LastUpdate   time.Time
+}
+
+// LandingHandler serves an overview of the accounts and their devices.
+type LandingHandler struct {
+	pollers []*Poller
+	links   []landingLink
+}
+
+func NewLandingHandler(pollers ...*Poller) *LandingHandler {
+	return &LandingHandler{pollers: pollers}
+}
+
+// AddLink lists an endpoint on the page.
+func (handler *LandingHandler) AddLink(path, description string) {
+	handler.links = append(handler.links, landingLink{Path: path, Description: description})
+}
+
+func (handler *LandingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := struct {
+		Version, Built, Commit string
+		Links                  []landingLink
+		Accounts               []*landingAccount
+	}{Version: Version, Built: Built, Commit: Commit, Links: handler.links}
+	for _, poller := range handler.pollers {
+		page.Accounts = append(page.Accounts, newLandingAccount(poller.Status()))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(w, page); err != nil {
+		slog.Warn("responding to root handler request failed", "error", err)
+	}
+}
+
+// newLandingAccount groups the devices of the last snapshot by location and room.
+func newLandingAccount(status PollerStatus) *landingAccount {
+	account := &landingAccount{PollerStatus: status}
+	snapshot := status.Snapshot
+	if snapshot == nil {
+		return account
+	}
+
+	locations := make(map[string]*landingLocation)
+	rooms := make(map[string]*landingRoom)
+	for _, device := range snapshot.Devices {
+		location, ok := locations[device.LocationID]
+		if !ok {
+			location = &landingLocation{Name: device.LocationID}
+			if l := snapshot.Location(device.LocationID); l != nil {
+				location.Name = l.Name
+			}
+			locations[device.LocationID] = location
+			account.Locations = append(account.Locations, location)
+		}
+
+		roomKey := device.LocationID + "/" + device.RoomID
+		room, ok := rooms[roomKey]
+		if !ok {
+			room = &landingRoom{Name: device.RoomID}
+			if r := snapshot.Room(device.RoomID); r != nil {
+				room.Name = r.Name
+			}
+			rooms[roomKey] = room
+			location.Rooms = append(location.Rooms, room)
+		}
+
+		label := device.Label
+		if label == "" {
+			label = device.Name
+		}
+		room.Devices = append(room.Devices, &landingDevice{
+			ID:           device.DeviceID,
+			Label:        label,
+			Capabilities: deviceCapabilities(device),
+			LastUpdate:   snapshot.LastUpdate(device.DeviceID),
+		})
+	}
+
+	sort.Slice(account.Locations, func(i, j int) bool { return account.Locations[i].Name < account.Locations[j].Name })
+	for _, location := range account.Locations {
+		sort.Slice(location.Rooms, func(i, j int) bool { return location.Rooms[i].Name < location.Rooms[j].Name })
+		for _, room := range location.Rooms {
+			sort.Slice(room.Devices, func(i, j int) bool { return room.Devices[i].Label < room.Devices[j].Label })
+		}
+	}
+
+	return account
+}
+
+func deviceCapabilities(device *smartthings.Device) []string {
+	seen := make(map[string]bool)
+	var capabilities []string
+	for _, component := range device.Components {
+		for _, capability := range component.Capabilities {
+			if !seen[capability.ID] {
+				seen[capability.ID] = true
+				capabilities = append(capabilities, capability.ID)
+			}
+		}
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
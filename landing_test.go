@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLandingHandler(t *testing.T) {
+	client := &fakeClient{
+		devices: []*smartthings.Device{{
+			DeviceID:   "dev-1",
+			Label:      "Porch Light",
+			LocationID: "loc-1",
+			RoomID:     "room-1",
+			Components: []*smartthings.Component{{ID: "main", Capabilities: []*smartthings.Capability{{ID: "switch"}, {ID: "healthCheck"}}}},
+		}},
+		locations: []*smartthings.Location{{ID: "loc-1", Name: "Home"}},
+		rooms:     []*smartthings.Room{{ID: "room-1", LocationID: "loc-1", Name: "Porch"}},
+	}
+	poller := NewPoller("home", client, "", DeviceFilter{}, 0)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+
+	landing := NewLandingHandler(poller)
+	landing.AddLink("/metrics", "metrics of all accounts")
+
+	rec := httptest.NewRecorder()
+	landing.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	assert.Contains(t, body, `<a href="/metrics">/metrics</a>`)
+	assert.Contains(t, body, "home / Home")
+	assert.Contains(t, body, "<td>Porch</td>")
+	assert.Contains(t, body, "<td>Porch Light</td>")
+	assert.Contains(t, body, "healthCheck, switch")
+
+	rec = httptest.NewRecorder()
+	landing.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger(&out, "warn", "json")
+	require.NoError(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("shown", "device_id", "dev-1")
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "shown", entry["msg"])
+	assert.Equal(t, "dev-1", entry["device_id"])
+
+	_, err = newLogger(&out, "verbose", "text")
+	assert.ErrorContains(t, err, "log_level")
+	_, err = newLogger(&out, "debug", "xml")
+	assert.ErrorContains(t, err, "log_format")
+}
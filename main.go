@@ -4,12 +4,14 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 
-	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/setheck/smartthings-exporter/smartthings"
@@ -29,54 +31,345 @@ var (
                                                 |___/                    |_|`, "q", "`")
 )
 
-type Configuration struct {
-	Port     int    `envconfig:"PORT" default:"9119"`
-	ApiToken string `envconfig:"API_TOKEN"`
-}
-
 var (
-	ver = flag.Bool("version", false, "print version and exit")
+	ver           = flag.Bool("version", false, "print version and exit")
+	configFile    = flag.String("config", "", "path to a yaml config file, environment variables override its values")
+	printConfig   = flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	webConfig     = flag.String("web.config.file", "", "path to a web config file with tls and basic auth settings, overrides STE_WEB_CONFIG_FILE")
+	listenAddress = flag.String("web.listen-address", "", "address to listen on, overrides STE_LISTEN_ADDRESS and the port")
+	pollInterval  = flag.Duration("poll.interval", 0, "poll the api in the background at this interval, overrides STE_POLL_INTERVAL")
+	logLevel      = flag.String("log.level", "", "log level, debug, info, warn or error, overrides STE_LOG_LEVEL")
+	logFormat     = flag.String("log.format", "", "log format, text or json, overrides STE_LOG_FORMAT")
+	dump          = flag.String("dump", "", "poll every account once, write the snapshots to this json file and exit")
+	replay        = flag.String("replay", "", "serve the metrics of a -dump file without a token or the api, overrides STE_REPLAY_FILE")
+	textfileDir   = flag.String("textfile.directory", "", "write the metrics to smartthings.prom in this node_exporter textfile directory instead of serving them, overrides STE_TEXTFILE_DIRECTORY")
+	once          = flag.Bool("once", false, "collect the metrics once, print them or write the textfile and exit")
+	simulate      = flag.Bool("simulate", false, "serve the metrics of simulated devices without a token or the api, overrides STE_SIMULATE")
 )
 
+// flagOverrides applies the flags set on the command line to the configuration.
+func flagOverrides(config *Configuration) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "web.config.file":
+			config.WebConfigFile = *webConfig
+		case "web.listen-address":
+			config.ListenAddress = *listenAddress
+		case "poll.interval":
+			config.PollInterval = *pollInterval
+		case "log.level":
+			config.LogLevel = *logLevel
+		case "log.format":
+			config.LogFormat = *logFormat
+		case "replay":
+			config.ReplayFile = *replay
+		case "simulate":
+			config.Simulate = *simulate
+		case "textfile.directory":
+			config.TextfileDirectory = *textfileDir
+		}
+	})
+}
+
 func main() {
 	flag.Parse()
-	fmt.Println(Banner)
-	fmt.Println("version:", Version)
-	fmt.Println("  built:", Built)
-	fmt.Println(" commit:", Commit)
+	// the printed configuration and metrics stay parseable without the banner
+	if !*printConfig && !*once {
+		fmt.Println(Banner)
+		fmt.Println("version:", Version)
+		fmt.Println("  built:", Built)
+		fmt.Println(" commit:", Commit)
+	}
 	if *ver {
 		os.Exit(0)
 	}
 
-	log.Println("starting up")
-	var config Configuration
-	if err := envconfig.Process("STE", &config); err != nil {
-		log.Fatal(err)
+	config, accounts, err := loadConfiguration("STE", *configFile, flagOverrides)
+	if err != nil {
+		fatal("loading configuration failed", "error", err)
+	}
+	if *printConfig {
+		if err := printConfiguration(os.Stdout, config); err != nil {
+			fatal("printing configuration failed", "error", err)
+		}
+		os.Exit(0)
 	}
 
-	log.Println("creating smartthings client")
-	client := smartthings.NewClient(config.ApiToken, nil)
-	if _, err := client.ListDevices(context.Background()); err != nil {
-		log.Fatal("failed to initialize client:", err)
+	logger, err := newLogger(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		fatal("creating logger failed", "error", err)
 	}
+	slog.SetDefault(logger)
 
-	log.Println("creating collector")
-	collector := NewCollector(client)
+	slog.Info("starting up", "version", Version)
+
+	// cancels the pollers and starts the graceful shutdown of the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	oauth := NewOAuthHandler()
+	var tokenFiles []*smartthings.FileTokenSource
+	var pollers []*Poller
+	switch {
+	case config.Simulate:
+		slog.Info("simulating devices, the api is not used", "homes", config.SimulateHomes, "rooms", config.SimulateRooms, "devices", config.SimulateDevices)
+		simulator := NewSimulator(SimulatorConfig{
+			Homes:   config.SimulateHomes,
+			Rooms:   config.SimulateRooms,
+			Devices: config.SimulateDevices,
+			Seed:    config.SimulateSeed,
+		})
+		filter := DeviceFilter{Include: config.IncludeDevices, Exclude: config.ExcludeDevices}
+		pollers = []*Poller{NewPoller("simulated", simulator, "", filter, config.PollInterval)}
+	case config.ReplayFile != "":
+		slog.Info("replaying snapshots, the api is not used", "path", config.ReplayFile)
+		if pollers, err = replayPollers(config.ReplayFile); err != nil {
+			fatal("loading snapshots failed", "error", err)
+		}
+	default:
+		pollers, tokenFiles = newPollers(ctx, config, accounts, oauth, logger)
+	}
+	if config.Webhook && (config.Simulate || config.ReplayFile != "") {
+		slog.Warn("webhook is disabled without the api")
+		config.Webhook = false
+	}
+
+	if *dump != "" {
+		if err := dumpSnapshots(ctx, pollers, *dump); err != nil {
+			fatal("dumping snapshots failed", "error", err)
+		}
+		slog.Info("dumped snapshots", "path", *dump, "accounts", len(pollers))
+		os.Exit(0)
+	}
+
+	if *once {
+		if err := collectOnce(ctx, pollers, config.TextfileDirectory, os.Stdout); err != nil {
+			fatal("collecting metrics failed", "error", err)
+		}
+		os.Exit(0)
+	}
+
+	if config.InfluxURL != "" {
+		influx := NewInfluxWriter(InfluxConfig{
+			URL:           config.InfluxURL,
+			Org:           config.InfluxOrg,
+			Bucket:        config.InfluxBucket,
+			Token:         config.InfluxToken,
+			BatchSize:     config.InfluxBatchSize,
+			FlushInterval: config.InfluxFlushInterval,
+		}, nil)
+		subscribe(pollers, "influxdb", influx.Write)
+		slog.Info("writing to influxdb", "url", config.InfluxURL, "bucket", config.InfluxBucket, "interval", config.InfluxFlushInterval)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			influx.Run(ctx)
+		}()
+		// the last lines are flushed once ctx is done
+		defer func() {
+			stop()
+			<-done
+		}()
+	}
+	if config.MQTTBroker != "" {
+		bridge := NewMQTTBridge(MQTTConfig{
+			Broker:          config.MQTTBroker,
+			ClientID:        config.MQTTClientID,
+			Username:        config.MQTTUsername,
+			Password:        config.MQTTPassword,
+			TopicPrefix:     config.MQTTTopicPrefix,
+			Discovery:       config.MQTTDiscovery,
+			DiscoveryPrefix: config.MQTTDiscoveryPrefix,
+		})
+		defer bridge.Close()
+		subscribe(pollers, "mqtt", bridge.Publish)
+		slog.Info("publishing to mqtt", "broker", config.MQTTBroker, "prefix", config.MQTTTopicPrefix, "discovery", config.MQTTDiscovery)
+	}
+
+	for _, poller := range pollers {
+		// initializes in the background, so the server is up while the api isn't reachable
+		go poller.Run(ctx)
+	}
+
+	slog.Debug("creating collector")
+	collector := NewCollector(pollers...)
+
+	auth := PushAuth{Username: config.PushUsername, Password: config.PushPassword, BearerToken: config.PushBearerToken}
+	var pushers []Pusher
+	if config.PushgatewayURL != "" {
+		slog.Info("pushing to pushgateway", "url", config.PushgatewayURL, "interval", config.PushInterval)
+		pushers = append(pushers, NewPushgateway(config.PushgatewayURL, config.PushgatewayJob, auth, nil, pollers...))
+	}
+	if config.RemoteWriteURL != "" {
+		slog.Info("pushing with remote write", "url", config.RemoteWriteURL, "interval", config.PushInterval)
+		pushers = append(pushers, NewRemoteWriter(config.RemoteWriteURL, auth, nil, pollers...))
+	}
+	if len(pushers) > 0 {
+		go runPush(ctx, config.PushInterval, pushers...)
+	}
+	if config.OTLPEndpoint != "" {
+		otlp, err := NewOTLPExporter(ctx, config.OTLPProtocol, config.OTLPEndpoint, config.OTLPHeaders, pollers...)
+		if err != nil {
+			fatal("creating otlp exporter failed", "error", err)
+		}
+		defer otlp.Shutdown(context.Background())
+		slog.Info("exporting otlp metrics", "endpoint", config.OTLPEndpoint, "protocol", config.OTLPProtocol, "interval", config.OTLPInterval)
+		go runPush(ctx, config.OTLPInterval, otlp)
+	}
+
+	if config.TextfileDirectory != "" {
+		// only the smartthings metrics, node_exporter has its own go and process metrics
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collector)
+		path := filepath.Join(config.TextfileDirectory, textfileName)
+		slog.Info("writing textfile instead of serving metrics", "path", path, "interval", config.TextfileInterval)
+		runTextfile(ctx, path, config.TextfileInterval, registry, pollers...)
+		slog.Info("stopped")
+		return
+	}
+
+	probe := NewProbeHandler(pollers...)
+
+	landing := NewLandingHandler(pollers...)
+	landing.AddLink("/metrics", "metrics of all accounts")
+	landing.AddLink("/probe?target="+pollers[0].Name(), "metrics of a single account, location or room")
+	landing.AddLink("/sd", "prometheus http service discovery of the locations")
+	landing.AddLink("/healthz", "liveness")
+	landing.AddLink("/readyz", "readiness of every account")
 
 	prometheus.MustRegister(collector)
-	http.HandleFunc("/", rootHandler)
+	http.Handle("/", landing)
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/probe", probe)
+	http.Handle("/healthz", LivenessHandler{})
+	http.Handle("/readyz", NewReadinessHandler(config.ReadinessStaleness, pollers...))
+	http.Handle("/sd", NewServiceDiscoveryHandler(pollers...))
+	if config.DebugAPI {
+		http.Handle("/api/", NewDebugAPI(pollers...))
+		landing.AddLink("/api/devices", "cached devices as json, /api/devices/{id}/status for the status and its metrics")
+		landing.AddLink("/api/locations", "cached locations and rooms as json")
+	}
+	if oauth.Len() > 0 {
+		http.HandleFunc("/oauth/login", oauth.Login)
+		http.HandleFunc("/oauth/callback", oauth.Callback)
+		landing.AddLink("/oauth/login", "authorize an oauth2 account")
+	}
+	if config.Webhook {
+		newClient := func(token string) SubscriptionClient {
+			return smartthings.NewClient(token, nil)
+		}
+		var webhook http.Handler = NewWebhook(newClient, pollers...).SmartApp()
+		if config.WebhookVerifySignatures {
+			webhook = smartthings.NewSignatureVerifier(nil).Middleware(webhook)
+		} else {
+			slog.Warn("webhook signature verification is disabled")
+		}
+		http.Handle("/webhook", webhook)
+		landing.AddLink("/webhook", "smartapp webhook receiving device events")
+	}
+
+	// only the token files are reloaded, the rest of the configuration needs a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("received SIGHUP, reloading token files")
+			reloadTokenFiles(tokenFiles)
+		}
+	}()
+
+	addr := config.ListenAddress
+	if addr == "" {
+		addr = fmt.Sprintf("0.0.0.0:%d", config.Port)
+	}
+	server := &http.Server{
+		Addr:         addr,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+	webServer, err := NewWebServer(config.WebConfigFile)
+	if err != nil {
+		fatal("invalid web config", "path", config.WebConfigFile, "error", err)
+	}
+	listenAndServe := func() error {
+		return webServer.ListenAndServe(server)
+	}
+
+	slog.Info("starting server", "address", server.Addr)
+	if err := serve(ctx, server, config.ShutdownGracePeriod, listenAndServe); err != nil {
+		fatal("server failed", "error", err)
+	}
+	slog.Info("stopped")
+}
+
+// subscribe calls fn with the snapshots of every poller, it warns about
+// the accounts that only poll on a scrape.
+func subscribe(pollers []*Poller, output string, fn func(*Snapshot)) {
+	for _, poller := range pollers {
+		if poller.Status().Interval == 0 {
+			slog.Warn("account only polls on a scrape, set poll_interval to update it regularly", "account", poller.Name(), "output", output)
+		}
+		poller.Subscribe(fn)
+	}
+}
+
+// newPollers creates a client and poller per account, token files are
+// watched until ctx is done. The pollers aren't started.
+func newPollers(ctx context.Context, config *Configuration, accounts []*AccountConfig, oauth *OAuthHandler, logger *slog.Logger) ([]*Poller, []*smartthings.FileTokenSource) {
+	var tokenFiles []*smartthings.FileTokenSource
+	var pollers []*Poller
+	for _, account := range accounts {
+		slog.Info("creating smartthings client", "account", account.Name)
+		var apiClient *smartthings.Client
+		switch {
+		case account.ApiTokenFile != "":
+			tokens, err := smartthings.NewFileTokenSource(account.ApiTokenFile)
+			if err != nil {
+				fatal("failed to read token file", "account", account.Name, "error", err)
+			}
+			go tokens.Watch(ctx, config.TokenFileInterval)
+			tokenFiles = append(tokenFiles, tokens)
+			apiClient = smartthings.NewTokenSourceClient(tokens, nil)
+		case account.OAuth():
+			tokens, err := smartthings.NewOAuthTokens(&smartthings.OAuthConfig{
+				ClientID:     account.OAuthClientID,
+				ClientSecret: account.OAuthClientSecret,
+				RedirectURL:  config.OAuthRedirectURL,
+				Scopes:       config.OAuthScopes,
+			}, &smartthings.FileTokenStore{Path: account.OAuthTokenFile})
+			if err != nil {
+				fatal("failed to load oauth2 token", "account", account.Name, "error", err)
+			}
+			oauth.AddAccount(account.Name, tokens)
+			apiClient = smartthings.NewOAuthClient(tokens, nil)
+		default:
+			apiClient = smartthings.NewClient(account.ApiToken, nil)
+		}
+		apiClient.SetLogger(logger.With("account", account.Name))
+
+		client := NewLimitedClient(apiClient, *account.RateLimit)
 
-	addr := fmt.Sprintf("0.0.0.0:%d", config.Port)
-	log.Println("starting server on", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+		interval := *account.PollInterval
+		if config.Webhook {
+			// events keep the state current, polling only reconciles
+			interval = config.WebhookReconcileInterval
+		}
+		poller := NewPoller(account.Name, client, account.Location, account.Filter(), interval)
+		pollers = append(pollers, poller)
 	}
+	return pollers, tokenFiles
 }
 
-func rootHandler(w http.ResponseWriter, _ *http.Request) {
-	// TODO:(smt) default page with info and usage etc...
-	if _, err := fmt.Fprint(w, "OK"); err != nil {
-		log.Println("responding to root handler request failed:", err)
+// reloadTokenFiles reloads the token files on SIGHUP, the new tokens are
+// used from the next api request on.
+func reloadTokenFiles(tokenFiles []*smartthings.FileTokenSource) {
+	for _, tokens := range tokenFiles {
+		changed, err := tokens.Reload()
+		if err != nil {
+			slog.Warn("reloading token file failed", "path", tokens.Path(), "error", err)
+		} else if changed {
+			slog.Info("reloaded token file", "path", tokens.Path())
+		}
 	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/setheck/smartthings-exporter/smartthings/smartthingstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadTokenFiles(t *testing.T) {
+	server := smartthingstest.NewServer(&smartthingstest.Fixture{
+		Token:   "new-token",
+		Devices: []*smartthings.Device{{DeviceID: "dev-1"}},
+	})
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("old-token\n"), 0o600))
+	tokens, err := smartthings.NewFileTokenSource(path)
+	require.NoError(t, err)
+	client := smartthings.NewTokenSourceClient(tokens, server.Server.Client())
+	client.SetBaseURL(server.APIURL())
+
+	_, err = client.ListDevices(context.Background())
+	assert.ErrorIs(t, err, smartthings.ErrUnauthorized)
+
+	require.NoError(t, os.WriteFile(path, []byte("new-token\n"), 0o600))
+	reloadTokenFiles([]*smartthings.FileTokenSource{tokens})
+	devices, err := client.ListDevices(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+
+	// an empty file, like a secret being replaced, keeps the token
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	reloadTokenFiles([]*smartthings.FileTokenSource{tokens})
+	_, err = client.ListDevices(context.Background())
+	assert.NoError(t, err)
+}
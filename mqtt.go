@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+// mqttSchemes are the broker url schemes of the mqtt client.
+var mqttSchemes = []string{"tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss"}
+
+// MQTTConfig configures the broker connection and topics of the bridge.
+type MQTTConfig struct {
+	Broker          string
+	ClientID        string
+	Username        string
+	Password        string
+	TopicPrefix     string
+	Discovery       bool
+	DiscoveryPrefix string
+}
+
+// MQTTBridge publishes the attributes of every snapshot of the pollers it's
+// subscribed to as retained messages, and optionally the Home Assistant
+// discovery configs of them. Only changed messages are published.
+type MQTTBridge struct {
+	config MQTTConfig
+	client mqtt.Client
+
+	mu sync.Mutex
+	// published is the last payload of every topic
+	published map[string]string
+	// devices are the devices of every account by id
+	devices map[string]mqttDevice
+	// topics are the last device topics by device id
+	topics map[string]string
+}
+
+// mqttDevice is the topic of a device before devices of the same name are
+// told apart.
+type mqttDevice struct {
+	account string
+	topic   string
+}
+
+// NewMQTTBridge creates the bridge and connects it in the background,
+// messages published meanwhile are sent once it's connected.
+func NewMQTTBridge(config MQTTConfig) *MQTTBridge {
+	bridge := &MQTTBridge{
+		config:    config,
+		published: make(map[string]string),
+		devices:   make(map[string]mqttDevice),
+		topics:    make(map[string]string),
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetWill(bridge.statusTopic(), "offline", 1, true).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetWriteTimeout(10 * time.Second).
+		SetOnConnectHandler(bridge.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("mqtt connection lost", "broker", config.Broker, "error", err)
+		})
+	bridge.client = mqtt.NewClient(options)
+	bridge.client.Connect()
+	return bridge
+}
+
+func (bridge *MQTTBridge) statusTopic() string {
+	return bridge.config.TopicPrefix + "/status"
+}
+
+// onConnect marks the bridge online, and forgets what was published, the
+// broker may have lost its retained messages.
+func (bridge *MQTTBridge) onConnect(client mqtt.Client) {
+	slog.Info("connected to mqtt broker", "broker", bridge.config.Broker)
+	bridge.mu.Lock()
+	clear(bridge.published)
+	bridge.mu.Unlock()
+	client.Publish(bridge.statusTopic(), 1, true, "online")
+}
+
+// Close marks the bridge offline and disconnects.
+func (bridge *MQTTBridge) Close() {
+	if bridge.client.IsConnectionOpen() {
+		bridge.client.Publish(bridge.statusTopic(), 1, true, "offline").WaitTimeout(time.Second)
+	}
+	bridge.client.Disconnect(250)
+}
+
+// Publish publishes the changed messages of the snapshot, it's meant for
+// Poller.Subscribe. The retained messages of a device whose topic moved
+// are cleared with empty ones.
+func (bridge *MQTTBridge) Publish(snapshot *Snapshot) {
+	messages, moved := bridge.messages(snapshot)
+
+	bridge.mu.Lock()
+	changed := make(map[string]string)
+	for previous, current := range moved {
+		for topic := range messages {
+			if !strings.HasPrefix(topic, current+"/") {
+				continue
+			}
+			if old := previous + strings.TrimPrefix(topic, current); messages[old] == "" {
+				changed[old] = ""
+				delete(bridge.published, old)
+			}
+		}
+	}
+	for topic, payload := range messages {
+		if previous, ok := bridge.published[topic]; !ok || previous != payload {
+			changed[topic] = payload
+			bridge.published[topic] = payload
+		}
+	}
+	bridge.mu.Unlock()
+
+	for _, topic := range sortedKeys(changed) {
+		token := bridge.client.Publish(topic, 1, true, changed[topic])
+		go func() {
+			<-token.Done()
+			if err := token.Error(); err != nil {
+				slog.Error("publishing to mqtt failed", "account", snapshot.Account, "topic", topic, "error", err)
+				// published again with the next snapshot
+				bridge.mu.Lock()
+				if bridge.published[topic] == changed[topic] {
+					delete(bridge.published, topic)
+				}
+				bridge.mu.Unlock()
+			}
+		}()
+	}
+}
+
+// messages maps the topics of the snapshot to their payloads, the state
+// topics are <prefix>/<location>/<room>/<device>/<capability>/<attribute>.
+// Capabilities of components other than main are prefixed with the
+// component, like outlet2_switch. It also returns the device topics that
+// moved since the last snapshot, mapped to where they moved.
+func (bridge *MQTTBridge) messages(snapshot *Snapshot) (map[string]string, map[string]string) {
+	deviceTopics, moved := bridge.deviceTopics(snapshot)
+	messages := make(map[string]string)
+	for _, device := range snapshot.Devices {
+		roomName := ""
+		if room := snapshot.Room(device.RoomID); room != nil {
+			roomName = room.Name
+		}
+		deviceTopic := deviceTopics[device.DeviceID]
+
+		for componentId, status := range snapshot.Status[device.DeviceID] {
+			for capabilityId, attributes := range status {
+				capability := capabilityId
+				if componentId != "main" {
+					capability = componentId + "_" + capabilityId
+				}
+				for attributeId, properties := range attributes {
+					payload, ok := mqttPayload(properties["value"])
+					if !ok {
+						continue
+					}
+					topic := deviceTopic + "/" + topicSegment(capability) + "/" + topicSegment(attributeId)
+					messages[topic] = payload
+
+					if !bridge.config.Discovery {
+						continue
+					}
+					if topic, config, ok := bridge.discovery(device, deviceName(device), roomName, componentId, capabilityId, attributeId, properties, topic); ok {
+						messages[topic] = config
+					}
+				}
+			}
+		}
+	}
+	return messages, moved
+}
+
+// deviceTopics maps the devices to <prefix>/<location>/<room>/<device>.
+// Devices without a room are in unassigned, a location that isn't known is
+// its id. Devices of the same name in a room, of any account, are told
+// apart by the start of their id, like lamp_3f2a9c1b. It also returns the
+// previous topics of the devices whose topic changed.
+func (bridge *MQTTBridge) deviceTopics(snapshot *Snapshot) (map[string]string, map[string]string) {
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	for deviceId, device := range bridge.devices {
+		if device.account == snapshot.Account {
+			delete(bridge.devices, deviceId)
+		}
+	}
+
+	for _, device := range snapshot.Devices {
+		locationName := device.LocationID
+		if location := snapshot.Location(device.LocationID); location != nil {
+			locationName = location.Name
+		}
+		roomName := ""
+		if room := snapshot.Room(device.RoomID); room != nil {
+			roomName = room.Name
+		}
+
+		topic := bridge.config.TopicPrefix
+		for _, name := range []string{locationName, roomName, deviceName(device)} {
+			topic += "/" + topicSegment(strings.ToLower(name))
+		}
+		bridge.devices[device.DeviceID] = mqttDevice{account: snapshot.Account, topic: topic}
+	}
+
+	names := make(map[string]int)
+	for _, device := range bridge.devices {
+		names[device.topic]++
+	}
+
+	topics := make(map[string]string, len(snapshot.Devices))
+	moved := make(map[string]string)
+	for _, device := range snapshot.Devices {
+		topic := bridge.devices[device.DeviceID].topic
+		if names[topic] > 1 {
+			topic += "_" + topicSegment(device.DeviceID[:min(len(device.DeviceID), 8)])
+		}
+		if previous, ok := bridge.topics[device.DeviceID]; ok && previous != topic {
+			moved[previous] = topic
+		}
+		bridge.topics[device.DeviceID] = topic
+		topics[device.DeviceID] = topic
+	}
+	return topics, moved
+}
+
+// deviceName is the label of a device, or its name or id without one.
+func deviceName(device *smartthings.Device) string {
+	switch {
+	case device.Label != "":
+		return device.Label
+	case device.Name != "":
+		return device.Name
+	default:
+		return device.DeviceID
+	}
+}
+
+// haEntity is how an attribute is represented in Home Assistant. The
+// bridge doesn't accept commands, so switches are binary sensors too.
+type haEntity struct {
+	component   string
+	deviceClass string
+	unit        string
+	stateClass  string
+	payloadOn   string
+	payloadOff  string
+}
+
+var haEntities = map[string]haEntity{
+	"battery/battery":                           {component: "sensor", deviceClass: "battery", unit: "%", stateClass: "measurement"},
+	"carbonDioxideMeasurement/carbonDioxide":    {component: "sensor", deviceClass: "carbon_dioxide", unit: "ppm", stateClass: "measurement"},
+	"contactSensor/contact":                     {component: "binary_sensor", deviceClass: "door", payloadOn: "open", payloadOff: "closed"},
+	"energyMeter/energy":                        {component: "sensor", deviceClass: "energy", unit: "kWh", stateClass: "total_increasing"},
+	"illuminanceMeasurement/illuminance":        {component: "sensor", deviceClass: "illuminance", unit: "lx", stateClass: "measurement"},
+	"motionSensor/motion":                       {component: "binary_sensor", deviceClass: "motion", payloadOn: "active", payloadOff: "inactive"},
+	"powerMeter/power":                          {component: "sensor", deviceClass: "power", unit: "W", stateClass: "measurement"},
+	"presenceSensor/presence":                   {component: "binary_sensor", deviceClass: "presence", payloadOn: "present", payloadOff: "not present"},
+	"relativeHumidityMeasurement/humidity":      {component: "sensor", deviceClass: "humidity", unit: "%", stateClass: "measurement"},
+	"switch/switch":                             {component: "binary_sensor", deviceClass: "power", payloadOn: "on", payloadOff: "off"},
+	"switchLevel/level":                         {component: "sensor", unit: "%", stateClass: "measurement"},
+	"temperatureMeasurement/temperature":        {component: "sensor", deviceClass: "temperature", unit: "°C", stateClass: "measurement"},
+	"thermostatHeatingSetpoint/heatingSetpoint": {component: "sensor", deviceClass: "temperature", unit: "°C", stateClass: "measurement"},
+	"voltageMeasurement/voltage":                {component: "sensor", deviceClass: "voltage", unit: "V", stateClass: "measurement"},
+	"waterSensor/water":                         {component: "binary_sensor", deviceClass: "moisture", payloadOn: "wet", payloadOff: "dry"},
+}
+
+// haUnits converts the smartthings units to the ones of Home Assistant.
+var haUnits = map[string]string{
+	"C": "°C",
+	"F": "°F",
+}
+
+// discovery returns the Home Assistant discovery topic and config of an
+// attribute, for the capabilities that have an entity.
+func (bridge *MQTTBridge) discovery(device *smartthings.Device, deviceName, roomName, componentId, capabilityId, attributeId string, properties smartthings.ComponentProperties, stateTopic string) (string, string, bool) {
+	entity, ok := haEntities[capabilityId+"/"+attributeId]
+	if !ok {
+		return "", "", false
+	}
+	if unit, ok := properties["unit"].(string); ok && entity.unit != "" {
+		if converted, ok := haUnits[unit]; ok {
+			unit = converted
+		}
+		entity.unit = unit
+	}
+
+	nodeId := topicSegment("smartthings_" + device.DeviceID)
+	objectId := topicSegment(componentId + "_" + capabilityId + "_" + attributeId)
+	name := attributeId
+	if componentId != "main" {
+		name = componentId + " " + attributeId
+	}
+
+	config := map[string]interface{}{
+		"name":               name,
+		"unique_id":          nodeId + "_" + objectId,
+		"object_id":          topicSegment(strings.ToLower(deviceName)) + "_" + objectId,
+		"state_topic":        stateTopic,
+		"availability_topic": bridge.statusTopic(),
+		"device": map[string]interface{}{
+			"identifiers":    []string{nodeId},
+			"name":           deviceName,
+			"manufacturer":   device.ManufacturerName,
+			"model":          device.DeviceTypeName,
+			"suggested_area": roomName,
+		},
+	}
+	for key, value := range map[string]string{
+		"device_class":        entity.deviceClass,
+		"unit_of_measurement": entity.unit,
+		"state_class":         entity.stateClass,
+		"payload_on":          entity.payloadOn,
+		"payload_off":         entity.payloadOff,
+	} {
+		if value != "" {
+			config[key] = value
+		}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", "", false
+	}
+	topic := fmt.Sprintf("%s/%s/%s/%s/config", bridge.config.DiscoveryPrefix, entity.component, nodeId, objectId)
+	return topic, string(data), true
+}
+
+// mqttPayload formats an attribute value, objects and lists as json.
+func mqttPayload(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(data), true
+	}
+}
+
+// topicSegment makes a name usable as a single topic level, without
+// wildcards and separators, like "Living Room" to Living_Room.
+func topicSegment(name string) string {
+	var segment strings.Builder
+	underscore := false
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			if underscore && segment.Len() > 0 {
+				segment.WriteByte('_')
+			}
+			underscore = false
+			segment.WriteRune(r)
+			continue
+		}
+		underscore = true
+	}
+	if segment.Len() == 0 {
+		return "unassigned"
+	}
+	return segment.String()
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mqttBroker is an embedded broker, counting the messages of every topic.
+type mqttBroker struct {
+	*mochi.Server
+	url string
+
+	mu       sync.Mutex
+	received map[string]int
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	require.NoError(t, server.AddListener(tcp))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	broker := &mqttBroker{Server: server, url: "tcp://" + tcp.Address(), received: make(map[string]int)}
+	require.NoError(t, server.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		broker.received[pk.TopicName]++
+	}))
+	return broker
+}
+
+// retained returns the retained payload of a topic, waiting for it.
+func (broker *mqttBroker) retained(t *testing.T, topic string) string {
+	var payload string
+	require.Eventually(t, func() bool {
+		messages := broker.Topics.Messages(topic)
+		if len(messages) == 0 {
+			return false
+		}
+		payload = string(messages[0].Payload)
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "no retained message on %s", topic)
+	return payload
+}
+
+func (broker *mqttBroker) count(topic string) int {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.received[topic]
+}
+
+func mqttConfig(url string) MQTTConfig {
+	return MQTTConfig{Broker: url, ClientID: "test", TopicPrefix: "smartthings", DiscoveryPrefix: "homeassistant"}
+}
+
+func TestMQTTBridgePublish(t *testing.T) {
+	broker := newMQTTBroker(t)
+	bridge := NewMQTTBridge(mqttConfig(broker.url))
+	defer bridge.Close()
+	assert.Equal(t, "online", broker.retained(t, "smartthings/status"))
+
+	client := fixtureClient()
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Minute)
+	poller.Subscribe(bridge.Publish)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+
+	temperature := "smartthings/home/kitchen/fridge_plug/temperatureMeasurement/temperature"
+	assert.Equal(t, "4.5", broker.retained(t, temperature))
+	assert.Equal(t, "3.21", broker.retained(t, "smartthings/home/kitchen/fridge_plug/energyMeter/energy"))
+	assert.Equal(t, "open", broker.retained(t, "smartthings/cabin/unassigned/back_door/contactSensor/contact"))
+	assert.Empty(t, broker.Topics.Messages("homeassistant/#"), "discovery is disabled")
+
+	// only changes are published
+	_, err = poller.Poll(context.Background())
+	require.NoError(t, err)
+	client.statuses["dev-2/main"] = smartthings.ComponentStatus{"contactSensor": {"contact": {"value": "closed"}}}
+	_, err = poller.Poll(context.Background())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return broker.retained(t, "smartthings/cabin/unassigned/back_door/contactSensor/contact") == "closed"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, broker.count(temperature))
+
+	bridge.Close()
+	assert.Equal(t, "offline", broker.retained(t, "smartthings/status"))
+}
+
+func TestMQTTBridgeDiscovery(t *testing.T) {
+	broker := newMQTTBroker(t)
+	config := mqttConfig(broker.url)
+	config.Discovery = true
+	bridge := NewMQTTBridge(config)
+	defer bridge.Close()
+	broker.retained(t, "smartthings/status")
+
+	bridge.Publish(&Snapshot{
+		Account:   "home",
+		Locations: []*smartthings.Location{{ID: "loc-1", Name: "Home"}},
+		Rooms:     []*smartthings.Room{{ID: "room-1", LocationID: "loc-1", Name: "Living Room"}},
+		Devices: []*smartthings.Device{{
+			DeviceID: "dev-1", Label: "Multi Sensor", ManufacturerName: "Acme", LocationID: "loc-1", RoomID: "room-1",
+		}},
+		Status: map[string]map[string]smartthings.ComponentStatus{
+			"dev-1": {"main": {
+				"temperatureMeasurement": {"temperature": {"value": 70.0, "unit": "F"}},
+				"contactSensor":          {"contact": {"value": "closed"}},
+				"lock":                   {"lock": {"value": "locked"}},
+			}},
+		},
+	})
+
+	var temperature map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(broker.retained(t, "homeassistant/sensor/smartthings_dev-1/main_temperatureMeasurement_temperature/config")), &temperature))
+	assert.Equal(t, map[string]interface{}{
+		"name":                "temperature",
+		"unique_id":           "smartthings_dev-1_main_temperatureMeasurement_temperature",
+		"object_id":           "multi_sensor_main_temperatureMeasurement_temperature",
+		"state_topic":         "smartthings/home/living_room/multi_sensor/temperatureMeasurement/temperature",
+		"availability_topic":  "smartthings/status",
+		"device_class":        "temperature",
+		"unit_of_measurement": "°F",
+		"state_class":         "measurement",
+		"device": map[string]interface{}{
+			"identifiers":    []interface{}{"smartthings_dev-1"},
+			"name":           "Multi Sensor",
+			"manufacturer":   "Acme",
+			"model":          "",
+			"suggested_area": "Living Room",
+		},
+	}, temperature)
+
+	var contact map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(broker.retained(t, "homeassistant/binary_sensor/smartthings_dev-1/main_contactSensor_contact/config")), &contact))
+	assert.Equal(t, "door", contact["device_class"])
+	assert.Equal(t, "open", contact["payload_on"])
+	assert.Equal(t, "closed", contact["payload_off"])
+
+	assert.Equal(t, "locked", broker.retained(t, "smartthings/home/living_room/multi_sensor/lock/lock"))
+	assert.Len(t, broker.Topics.Messages("homeassistant/#"), 2, "capabilities without an entity aren't discovered")
+}
+
+func TestMQTTBridgeDeviceTopics(t *testing.T) {
+	bridge := &MQTTBridge{config: mqttConfig(""), devices: make(map[string]mqttDevice), topics: make(map[string]string)}
+	status := smartthings.ComponentStatus{"switch": {"switch": {"value": "on"}}}
+	messages, moved := bridge.messages(&Snapshot{
+		Account:   "home",
+		Locations: []*smartthings.Location{{ID: "loc-1", Name: "Home"}},
+		Rooms:     []*smartthings.Room{{ID: "room-1", LocationID: "loc-1", Name: "Kitchen"}},
+		Devices: []*smartthings.Device{
+			{DeviceID: "3f2a9c1b-0000-4000-8000-000000000001", Label: "Lamp", LocationID: "loc-1", RoomID: "room-1"},
+			{DeviceID: "7d41e0aa-0000-4000-8000-000000000002", Label: "lamp", LocationID: "loc-1", RoomID: "room-1"},
+			{DeviceID: "dev-3", Label: "Lamp", LocationID: "loc-1"},
+			{DeviceID: "dev-4", Name: "c2c-switch", LocationID: "loc-9", RoomID: "room-9"},
+		},
+		Status: map[string]map[string]smartthings.ComponentStatus{
+			"3f2a9c1b-0000-4000-8000-000000000001": {"main": status},
+			"7d41e0aa-0000-4000-8000-000000000002": {"main": status},
+			"dev-3":                                {"main": status},
+			"dev-4":                                {"main": status},
+		},
+	})
+
+	assert.Equal(t, map[string]string{
+		"smartthings/home/kitchen/lamp_3f2a9c1b/switch/switch":  "on",
+		"smartthings/home/kitchen/lamp_7d41e0aa/switch/switch":  "on",
+		"smartthings/home/unassigned/lamp/switch/switch":        "on",
+		"smartthings/loc-9/unassigned/c2c-switch/switch/switch": "on",
+	}, messages)
+	assert.Empty(t, moved)
+
+	// devices of another account with the same topic are told apart too
+	messages, moved = bridge.messages(&Snapshot{
+		Account:   "cabin",
+		Locations: []*smartthings.Location{{ID: "loc-2", Name: "Home"}},
+		Devices:   []*smartthings.Device{{DeviceID: "dev-5", Label: "lamp", LocationID: "loc-2"}},
+		Status:    map[string]map[string]smartthings.ComponentStatus{"dev-5": {"main": status}},
+	})
+	assert.Equal(t, map[string]string{"smartthings/home/unassigned/lamp_dev-5/switch/switch": "on"}, messages)
+	assert.Empty(t, moved)
+
+	messages, moved = bridge.messages(&Snapshot{
+		Account:   "home",
+		Locations: []*smartthings.Location{{ID: "loc-1", Name: "Home"}},
+		Devices:   []*smartthings.Device{{DeviceID: "dev-3", Label: "Lamp", LocationID: "loc-1"}},
+		Status:    map[string]map[string]smartthings.ComponentStatus{"dev-3": {"main": status}},
+	})
+	assert.Equal(t, map[string]string{"smartthings/home/unassigned/lamp_dev-3/switch/switch": "on"}, messages)
+	assert.Equal(t, map[string]string{"smartthings/home/unassigned/lamp": "smartthings/home/unassigned/lamp_dev-3"}, moved)
+}
+
+func TestMQTTBridgeClearsMovedTopics(t *testing.T) {
+	broker := newMQTTBroker(t)
+	bridge := NewMQTTBridge(mqttConfig(broker.url))
+	defer bridge.Close()
+	broker.retained(t, "smartthings/status")
+
+	client := fixtureClient()
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Minute)
+	poller.Subscribe(bridge.Publish)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "open", broker.retained(t, "smartthings/cabin/unassigned/back_door/contactSensor/contact"))
+
+	client.devices[1].Label = "garden door"
+	_, err = poller.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "open", broker.retained(t, "smartthings/cabin/unassigned/garden_door/contactSensor/contact"))
+	require.Eventually(t, func() bool {
+		return len(broker.Topics.Messages("smartthings/cabin/unassigned/back_door/#")) == 0
+	}, 5*time.Second, 10*time.Millisecond, "the old topic is cleared")
+}
+
+func TestTopicSegment(t *testing.T) {
+	for name, want := range map[string]string{
+		"kitchen":           "kitchen",
+		"Living Room":       "Living_Room",
+		"a/b+c#d":           "a_b_c_d",
+		"  front -- door  ": "front_--_door",
+		"café":              "café",
+		"":                  "unassigned",
+		"///":               "unassigned",
+	} {
+		assert.Equal(t, want, topicSegment(name), name)
+	}
+}
+
+func TestMQTTPayload(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  string
+		ok    bool
+	}{
+		{"on", "on", true},
+		{21.5, "21.5", true},
+		{false, "false", true},
+		{[]interface{}{"a", "b"}, `["a","b"]`, true},
+		{map[string]interface{}{"x": 1.0}, `{"x":1}`, true},
+		{nil, "", false},
+	} {
+		got, ok := mqttPayload(test.value)
+		assert.Equal(t, test.ok, ok, test.value)
+		assert.Equal(t, test.want, got, test.value)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+const oauthStateTTL = 10 * time.Minute
+
+type oauthState struct {
+	account string
+	expires time.Time
+}
+
+// OAuthHandler bootstraps the oauth2 accounts: /oauth/login redirects to
+// smartthings to authorize an account, which redirects back to
+// /oauth/callback with the authorization code.
+type OAuthHandler struct {
+	accounts map[string]*smartthings.OAuthTokens
+	now      func() time.Time
+
+	mu     sync.Mutex
+	states map[string]oauthState
+}
+
+func NewOAuthHandler() *OAuthHandler {
+	return &OAuthHandler{
+		accounts: make(map[string]*smartthings.OAuthTokens),
+		now:      time.Now,
+		states:   make(map[string]oauthState),
+	}
+}
+
+func (handler *OAuthHandler) AddAccount(name string, tokens *smartthings.OAuthTokens) {
+	handler.accounts[name] = tokens
+}
+
+func (handler *OAuthHandler) Len() int {
+	return len(handler.accounts)
+}
+
+// Login redirects to the authorization page of ?account=<name>, which can
+// be left out with a single oauth2 account. An account that is already
+// authorized is only authorized again with ?force=true, so the login page
+// can't be used to swap the token of a running exporter by accident.
+func (handler *OAuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("account")
+	if name == "" && len(handler.accounts) == 1 {
+		for name = range handler.accounts {
+		}
+	}
+
+	tokens, ok := handler.accounts[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown oauth2 account %q", name), http.StatusBadRequest)
+		return
+	}
+	if force, _ := strconv.ParseBool(r.URL.Query().Get("force")); tokens.Authorized() && !force {
+		http.Error(w, fmt.Sprintf("oauth2 account %s is already authorized, add force=true to authorize it again", name), http.StatusConflict)
+		return
+	}
+
+	state, err := handler.newState(name)
+	if err != nil {
+		slog.Error("oauth login failed", "account", name, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, tokens.Config().AuthCodeURL(state), http.StatusFound)
+}
+
+func (handler *OAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name, ok := handler.takeState(query.Get("state"))
+	if !ok {
+		http.Error(w, "invalid or expired state, start over at /oauth/login", http.StatusBadRequest)
+		return
+	}
+	if oauthErr := query.Get("error"); oauthErr != "" {
+		http.Error(w, fmt.Sprintf("authorization failed: %s %s", oauthErr, query.Get("error_description")), http.StatusBadRequest)
+		return
+	}
+
+	if err := handler.accounts[name].Exchange(r.Context(), query.Get("code")); err != nil {
+		slog.Error("oauth callback failed", "account", name, "error", err)
+		http.Error(w, "authorization failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	slog.Info("oauth account authorized", "account", name)
+	if _, err := fmt.Fprintf(w, "account %s authorized", name); err != nil {
+		slog.Warn("responding to oauth callback request failed", "error", err)
+	}
+}
+
+func (handler *OAuthHandler) newState(account string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(b)
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	now := handler.now()
+	for s, pending := range handler.states {
+		if now.After(pending.expires) {
+			delete(handler.states, s)
+		}
+	}
+	handler.states[state] = oauthState{account: account, expires: now.Add(oauthStateTTL)}
+
+	return state, nil
+}
+
+// takeState returns the account of a pending state, a state can only be used once.
+func (handler *OAuthHandler) takeState(state string) (string, bool) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	pending, ok := handler.states[state]
+	delete(handler.states, state)
+	if !ok || handler.now().After(pending.expires) {
+		return "", false
+	}
+	return pending.account, true
+}
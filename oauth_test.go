@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newOAuthTokens returns unauthorized tokens of an app whose token
+// endpoint only accepts the code "the-code".
+func newOAuthTokens(t *testing.T) *smartthings.OAuthTokens {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("code") != "the-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "invalid code"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "refresh_token": "refresh", "expires_in": 86399})
+	}))
+	t.Cleanup(tokenServer.Close)
+
+	tokens, err := smartthings.NewOAuthTokens(&smartthings.OAuthConfig{
+		ClientID:     "client-id",
+		RedirectURL:  "http://localhost/oauth/callback",
+		AuthorizeURL: "https://auth.example.com/authorize",
+		TokenURL:     tokenServer.URL,
+	}, &smartthings.FileTokenStore{Path: filepath.Join(t.TempDir(), "home.token.json")})
+	require.NoError(t, err)
+	return tokens
+}
+
+// login starts the authorization of the account and returns the state
+// smartthings is asked to redirect back with.
+func login(t *testing.T, handler *OAuthHandler, query string) string {
+	rec := httptest.NewRecorder()
+	handler.Login(rec, httptest.NewRequest(http.MethodGet, "/oauth/login"+query, nil))
+	require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "auth.example.com", location.Host)
+	assert.Equal(t, "client-id", location.Query().Get("client_id"))
+	state := location.Query().Get("state")
+	require.Len(t, state, 32)
+	return state
+}
+
+func callback(handler *OAuthHandler, state, code string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	query := url.Values{"state": {state}, "code": {code}}
+	handler.Callback(rec, httptest.NewRequest(http.MethodGet, "/oauth/callback?"+query.Encode(), nil))
+	return rec
+}
+
+func TestOAuthHandler(t *testing.T) {
+	tokens := newOAuthTokens(t)
+	handler := NewOAuthHandler()
+	handler.AddAccount("home", tokens)
+
+	rec := httptest.NewRecorder()
+	handler.Login(rec, httptest.NewRequest(http.MethodGet, "/oauth/login?account=other", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "unknown account")
+
+	state := login(t, handler, "")
+	assert.NotEqual(t, state, login(t, handler, "?account=home"), "states are random")
+
+	assert.Equal(t, http.StatusBadRequest, callback(handler, "other-state", "the-code").Code, "state mismatch")
+	assert.False(t, tokens.Authorized())
+
+	rec = callback(handler, state, "wrong-code")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid_grant")
+	assert.False(t, tokens.Authorized())
+	assert.Equal(t, http.StatusBadRequest, callback(handler, state, "the-code").Code, "states are only used once")
+
+	state = login(t, handler, "")
+	rec = callback(handler, state, "the-code")
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.True(t, tokens.Authorized())
+
+	rec = httptest.NewRecorder()
+	handler.Login(rec, httptest.NewRequest(http.MethodGet, "/oauth/login", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code, "already authorized")
+	login(t, handler, "?force=true")
+}
+
+func TestOAuthHandlerStateExpiry(t *testing.T) {
+	handler := NewOAuthHandler()
+	handler.AddAccount("home", newOAuthTokens(t))
+
+	now := time.Now()
+	handler.now = func() time.Time { return now }
+	state := login(t, handler, "")
+	now = now.Add(oauthStateTTL + time.Second)
+
+	rec := callback(handler, state, "the-code")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "expired")
+}
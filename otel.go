@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const (
+	otlpProtocolHTTP = "http/protobuf"
+	otlpProtocolGRPC = "grpc"
+)
+
+// otlpSums are the attributes of cumulative meters, exported as monotonic
+// sums instead of gauges.
+var otlpSums = map[string]bool{
+	"energy": true,
+}
+
+// otlpUnits maps the units of the smartthings api to UCUM units.
+var otlpUnits = map[string]string{
+	"C":   "Cel",
+	"F":   "[degF]",
+	"kWh": "kW.h",
+	"Wh":  "W.h",
+	"lux": "lx",
+}
+
+// OTLPExporter exports the device attributes of the accounts as OTLP
+// metrics. Every location of an account is a resource, devices and rooms
+// are data point attributes.
+type OTLPExporter struct {
+	exporter sdkmetric.Exporter
+	pollers  []*Poller
+	start    time.Time
+	now      func() time.Time
+}
+
+// NewOTLPExporter exports to endpoint, a url like http://localhost:4318
+// for http/protobuf or http://localhost:4317 for grpc. An http scheme
+// disables tls.
+func NewOTLPExporter(ctx context.Context, protocol, endpoint string, headers map[string]string, pollers ...*Poller) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var exporter sdkmetric.Exporter
+	switch protocol {
+	case otlpProtocolHTTP:
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		exporter, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(u.String()), otlpmetrichttp.WithHeaders(headers))
+	case otlpProtocolGRPC:
+		exporter, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(u.String()), otlpmetricgrpc.WithHeaders(headers))
+	default:
+		return nil, fmt.Errorf("unknown otlp protocol %q", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPExporter{exporter: exporter, pollers: pollers, start: time.Now(), now: time.Now}, nil
+}
+
+func (otlp *OTLPExporter) Push(ctx context.Context) error {
+	var errs []error
+	for _, poller := range otlp.pollers {
+		for _, metrics := range otlp.resourceMetrics(ctx, poller) {
+			if err := otlp.exporter.Export(ctx, metrics); err != nil {
+				errs = append(errs, fmt.Errorf("account %s: %w", poller.Name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (otlp *OTLPExporter) Shutdown(ctx context.Context) error {
+	return otlp.exporter.Shutdown(ctx)
+}
+
+// resourceMetrics converts the snapshot of the account, with a resource per
+// location. An account that was never polled only reports smartthings.up,
+// a failing one its last snapshot with smartthings.up 0.
+func (otlp *OTLPExporter) resourceMetrics(ctx context.Context, poller *Poller) []*metricdata.ResourceMetrics {
+	now := otlp.now()
+	account := attribute.String("smartthings.account", poller.Name())
+
+	snapshot, err := poller.Snapshot(ctx)
+	if snapshot == nil {
+		return []*metricdata.ResourceMetrics{otlpResourceMetrics([]attribute.KeyValue{account}, []metricdata.Metrics{otlpUp(now, 0)})}
+	}
+	up := float64(1)
+	if err != nil {
+		// the last good snapshot is exported while the api is failing
+		up = 0
+	}
+
+	// devices of unknown locations are exported with the account only
+	byLocation := map[string][]*smartthings.Device{}
+	for _, device := range snapshot.Devices {
+		locationId := device.LocationID
+		if snapshot.Location(locationId) == nil {
+			locationId = ""
+		}
+		byLocation[locationId] = append(byLocation[locationId], device)
+	}
+	locationIds := make([]string, 0, len(byLocation))
+	for locationId := range byLocation {
+		locationIds = append(locationIds, locationId)
+	}
+	sort.Strings(locationIds)
+	if len(locationIds) == 0 {
+		locationIds = append(locationIds, "")
+	}
+
+	var resources []*metricdata.ResourceMetrics
+	for _, locationId := range locationIds {
+		attributes := []attribute.KeyValue{account}
+		if location := snapshot.Location(locationId); location != nil {
+			attributes = append(attributes,
+				attribute.String("smartthings.location.id", location.ID),
+				attribute.String("smartthings.location.name", location.Name))
+		}
+		metrics := append([]metricdata.Metrics{otlpUp(now, up)}, otlp.deviceMetrics(snapshot, byLocation[locationId], now)...)
+		resources = append(resources, otlpResourceMetrics(attributes, metrics))
+	}
+	return resources
+}
+
+// deviceMetrics converts the attributes of the devices, the values are
+// parsed like for the prometheus metrics.
+func (otlp *OTLPExporter) deviceMetrics(snapshot *Snapshot, devices []*smartthings.Device, now time.Time) []metricdata.Metrics {
+	type metricKey struct{ name, unit string }
+	points := map[metricKey][]metricdata.DataPoint[float64]{}
+
+	for _, device := range devices {
+		deviceAttributes := []attribute.KeyValue{
+			attribute.String("smartthings.device.id", device.DeviceID),
+			attribute.String("smartthings.device.label", device.Label),
+		}
+		if room := snapshot.Room(device.RoomID); room != nil {
+			deviceAttributes = append(deviceAttributes,
+				attribute.String("smartthings.room.id", room.ID),
+				attribute.String("smartthings.room.name", room.Name))
+		}
+
+		for componentId, componentStatus := range snapshot.Status[device.DeviceID] {
+			for capabilityId, attributes := range componentStatus {
+				for attributeId, properties := range attributes {
+					value, ok := properties["value"]
+					if !ok {
+						continue
+					}
+					extras, number := parseValue(attributeId, value)
+
+					pointAttributes := append([]attribute.KeyValue{
+						attribute.String("smartthings.component", componentId),
+						attribute.String("smartthings.capability", capabilityId),
+					}, deviceAttributes...)
+					for k, v := range extras {
+						pointAttributes = append(pointAttributes, attribute.String(k, v))
+					}
+
+					unit, _ := properties["unit"].(string)
+					if ucum, ok := otlpUnits[unit]; ok {
+						unit = ucum
+					}
+					key := metricKey{name: "smartthings.attribute." + attributeId, unit: unit}
+					points[key] = append(points[key], metricdata.DataPoint[float64]{
+						Attributes: attribute.NewSet(pointAttributes...),
+						StartTime:  otlp.start,
+						Time:       now,
+						Value:      number,
+					})
+				}
+			}
+		}
+	}
+
+	keys := make([]metricKey, 0, len(points))
+	for key := range points {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].unit < keys[j].unit
+	})
+
+	metrics := make([]metricdata.Metrics, 0, len(keys))
+	for _, key := range keys {
+		attributeId := key.name[len("smartthings.attribute."):]
+		var data metricdata.Aggregation = metricdata.Gauge[float64]{DataPoints: points[key]}
+		if otlpSums[attributeId] {
+			data = metricdata.Sum[float64]{
+				DataPoints:  points[key],
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			}
+		}
+		metrics = append(metrics, metricdata.Metrics{Name: key.name, Unit: key.unit, Data: data})
+	}
+	return metrics
+}
+
+func otlpUp(now time.Time, value float64) metricdata.Metrics {
+	return metricdata.Metrics{
+		Name:        "smartthings.up",
+		Description: "whether the last request to the smartthings api succeeded",
+		Data:        metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{{Time: now, Value: value}}},
+	}
+}
+
+func otlpResourceMetrics(attributes []attribute.KeyValue, metrics []metricdata.Metrics) *metricdata.ResourceMetrics {
+	attributes = append([]attribute.KeyValue{
+		attribute.String("service.name", "smartthings-exporter"),
+		attribute.String("service.version", Version),
+	}, attributes...)
+	return &metricdata.ResourceMetrics{
+		Resource: resource.NewSchemaless(attributes...),
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: "github.com/setheck/smartthings-exporter", Version: Version},
+			Metrics: metrics,
+		}},
+	}
+}
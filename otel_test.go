@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector is a stand-in of an opentelemetry collector, receiving
+// metrics over grpc or decoding the ones recorded over http.
+type otlpCollector struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+
+	mu        sync.Mutex
+	resources []*metricpb.ResourceMetrics
+	headers   map[string]string
+}
+
+func (collector *otlpCollector) Export(ctx context.Context, request *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	collector.receive(request, md.Get("authorization"))
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+// received decodes the requests of the http exporter.
+func (collector *otlpCollector) received(t *testing.T, recorder *httpRecorder) {
+	for _, request := range recorder.recorded() {
+		require.Equal(t, "/v1/metrics", request.path)
+		var export colmetricpb.ExportMetricsServiceRequest
+		require.NoError(t, proto.Unmarshal(request.body, &export))
+		collector.receive(&export, request.header.Values("Authorization"))
+	}
+}
+
+func (collector *otlpCollector) receive(request *colmetricpb.ExportMetricsServiceRequest, authorization []string) {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	collector.resources = append(collector.resources, request.GetResourceMetrics()...)
+	if len(authorization) > 0 {
+		collector.headers = map[string]string{"authorization": authorization[0]}
+	}
+}
+
+func otlpAttributes(attributes []*commonpb.KeyValue) map[string]string {
+	values := make(map[string]string)
+	for _, kv := range attributes {
+		values[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	return values
+}
+
+// resource finds the received resource of a location.
+func (collector *otlpCollector) resource(t *testing.T, locationId string) *metricpb.ResourceMetrics {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for _, resource := range collector.resources {
+		if otlpAttributes(resource.GetResource().GetAttributes())["smartthings.location.id"] == locationId {
+			return resource
+		}
+	}
+	t.Fatalf("no resource of location %s", locationId)
+	return nil
+}
+
+func otlpMetric(resource *metricpb.ResourceMetrics, name string) *metricpb.Metric {
+	for _, scope := range resource.GetScopeMetrics() {
+		for _, metric := range scope.GetMetrics() {
+			if metric.GetName() == name {
+				return metric
+			}
+		}
+	}
+	return nil
+}
+
+func assertOTLPMetrics(t *testing.T, collector *otlpCollector) {
+	assert.Len(t, collector.resources, 2)
+
+	home := collector.resource(t, "loc-1")
+	assert.Equal(t, map[string]string{
+		"service.name":              "smartthings-exporter",
+		"service.version":           Version,
+		"smartthings.account":       "home",
+		"smartthings.location.id":   "loc-1",
+		"smartthings.location.name": "home",
+	}, otlpAttributes(home.GetResource().GetAttributes()))
+
+	up := otlpMetric(home, "smartthings.up")
+	require.NotNil(t, up)
+	assert.Equal(t, float64(1), up.GetGauge().GetDataPoints()[0].GetAsDouble())
+
+	energy := otlpMetric(home, "smartthings.attribute.energy")
+	require.NotNil(t, energy)
+	assert.Equal(t, "kW.h", energy.GetUnit())
+	require.NotNil(t, energy.GetSum(), "energy is a counter")
+	assert.True(t, energy.GetSum().GetIsMonotonic())
+	assert.Equal(t, metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, energy.GetSum().GetAggregationTemporality())
+	point := energy.GetSum().GetDataPoints()[0]
+	assert.Equal(t, 3.21, point.GetAsDouble())
+	assert.Equal(t, map[string]string{
+		"smartthings.component":    "main",
+		"smartthings.capability":   "energyMeter",
+		"smartthings.device.id":    "dev-1",
+		"smartthings.device.label": "fridge plug",
+		"smartthings.room.id":      "room-1",
+		"smartthings.room.name":    "kitchen",
+	}, otlpAttributes(point.GetAttributes()))
+
+	temperature := otlpMetric(home, "smartthings.attribute.temperature")
+	require.NotNil(t, temperature)
+	assert.Equal(t, "Cel", temperature.GetUnit())
+	assert.Equal(t, 4.5, temperature.GetGauge().GetDataPoints()[0].GetAsDouble())
+
+	cabin := collector.resource(t, "loc-2")
+	contact := otlpMetric(cabin, "smartthings.attribute.contact")
+	require.NotNil(t, contact)
+	point = contact.GetGauge().GetDataPoints()[0]
+	assert.Equal(t, float64(0), point.GetAsDouble())
+	assert.Equal(t, "open", otlpAttributes(point.GetAttributes())["state"])
+	assert.Nil(t, otlpMetric(cabin, "smartthings.attribute.energy"))
+}
+
+func TestOTLPExporterHTTP(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	ctx := context.Background()
+	otlp, err := NewOTLPExporter(ctx, otlpProtocolHTTP, recorder.URL, map[string]string{"Authorization": "Bearer token"},
+		NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0))
+	require.NoError(t, err)
+	defer otlp.Shutdown(ctx)
+
+	require.NoError(t, otlp.Push(ctx))
+	collector := &otlpCollector{}
+	collector.received(t, recorder)
+	assertOTLPMetrics(t, collector)
+	assert.Equal(t, "Bearer token", collector.headers["authorization"])
+}
+
+func TestOTLPExporterGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	collector := &otlpCollector{}
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, collector)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	ctx := context.Background()
+	otlp, err := NewOTLPExporter(ctx, otlpProtocolGRPC, "http://"+listener.Addr().String(), map[string]string{"authorization": "Bearer token"},
+		NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0))
+	require.NoError(t, err)
+	defer otlp.Shutdown(ctx)
+
+	require.NoError(t, otlp.Push(ctx))
+	assertOTLPMetrics(t, collector)
+	assert.Equal(t, "Bearer token", collector.headers["authorization"])
+}
+
+func TestOTLPExporterAccountDown(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	ctx := context.Background()
+	otlp, err := NewOTLPExporter(ctx, otlpProtocolHTTP, recorder.URL, nil,
+		NewPoller("broken", &fakeClient{err: io.ErrUnexpectedEOF}, "", DeviceFilter{}, 0))
+	require.NoError(t, err)
+	defer otlp.Shutdown(ctx)
+
+	require.NoError(t, otlp.Push(ctx))
+	collector := &otlpCollector{}
+	collector.received(t, recorder)
+	require.Len(t, collector.resources, 1)
+	resource := collector.resources[0]
+	assert.Equal(t, "broken", otlpAttributes(resource.GetResource().GetAttributes())["smartthings.account"])
+	up := otlpMetric(resource, "smartthings.up")
+	require.NotNil(t, up)
+	assert.Equal(t, float64(0), up.GetGauge().GetDataPoints()[0].GetAsDouble())
+}
+
+func TestNewOTLPExporterProtocol(t *testing.T) {
+	_, err := NewOTLPExporter(context.Background(), "udp", "http://localhost:4318", nil)
+	assert.ErrorContains(t, err, `unknown otlp protocol "udp"`)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"golang.org/x/time/rate"
+)
+
+var (
+	initialBackoff = time.Second
+	maxBackoff     = 5 * time.Minute
+
+	errNotPolled = errors.New("account has not been polled yet")
+)
+
+// Snapshot is the result of a single poll of an account.
+type Snapshot struct {
+	Account   string                                            `json:"account"`
+	Time      time.Time                                         `json:"time"`
+	Locations []*smartthings.Location                           `json:"locations"`
+	Rooms     []*smartthings.Room                               `json:"rooms"`
+	Devices   []*smartthings.Device                             `json:"devices"`
+	Status    map[string]map[string]smartthings.ComponentStatus `json:"status"`
+}
+
+func (snapshot *Snapshot) Location(locationId string) *smartthings.Location {
+	for _, location := range snapshot.Locations {
+		if location.ID == locationId {
+			return location
+		}
+	}
+	return nil
+}
+
+func (snapshot *Snapshot) Room(roomId string) *smartthings.Room {
+	for _, room := range snapshot.Rooms {
+		if room.ID == roomId {
+			return room
+		}
+	}
+	return nil
+}
+
+// FindLocation finds a location by id or name.
+func (snapshot *Snapshot) FindLocation(location string) *smartthings.Location {
+	for _, l := range snapshot.Locations {
+		if l.ID == location || strings.EqualFold(l.Name, location) {
+			return l
+		}
+	}
+	return nil
+}
+
+// FindRoom finds a room of a location by id or name.
+func (snapshot *Snapshot) FindRoom(locationId, room string) *smartthings.Room {
+	for _, r := range snapshot.Rooms {
+		if r.LocationID == locationId && (r.ID == room || strings.EqualFold(r.Name, room)) {
+			return r
+		}
+	}
+	return nil
+}
+
+// LastUpdate is the latest attribute timestamp of a device.
+func (snapshot *Snapshot) LastUpdate(deviceId string) time.Time {
+	var last time.Time
+	for _, componentStatus := range snapshot.Status[deviceId] {
+		for _, attributes := range componentStatus {
+			for _, properties := range attributes {
+				timestamp, ok := properties["timestamp"].(string)
+				if !ok {
+					continue
+				}
+				if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil && t.After(last) {
+					last = t
+				}
+			}
+		}
+	}
+	return last
+}
+
+// PollerStatus describes the polling of an account, Snapshot is the last
+// successful one.
+type PollerStatus struct {
+	Account     string
+	Interval    time.Duration
+	Ready       bool
+	LastPoll    time.Time
+	LastSuccess time.Time
+	Error       error
+	Snapshot    *Snapshot
+}
+
+// DeviceFilter selects devices by id, label or name. An empty Include
+// matches every device.
+type DeviceFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (filter DeviceFilter) Match(device *smartthings.Device) bool {
+	if matchDevice(filter.Exclude, device) {
+		return false
+	}
+	return len(filter.Include) == 0 || matchDevice(filter.Include, device)
+}
+
+func matchDevice(patterns []string, device *smartthings.Device) bool {
+	for _, pattern := range patterns {
+		if pattern == device.DeviceID ||
+			strings.EqualFold(pattern, device.Label) ||
+			strings.EqualFold(pattern, device.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Poller collects snapshots for a single account. With a zero interval the
+// api is queried on every call to Snapshot, otherwise Run refreshes the
+// snapshot in the background and Snapshot returns the latest one.
+type Poller struct {
+	name     string
+	client   SmartthingsClient
+	location string
+	filter   DeviceFilter
+	interval time.Duration
+
+	mu          sync.RWMutex
+	locationId  string
+	snapshot    *Snapshot
+	err         error
+	ready       bool
+	lastPoll    time.Time
+	polled      chan struct{}
+	subscribers []func(*Snapshot)
+}
+
+func NewPoller(name string, client SmartthingsClient, location string, filter DeviceFilter, interval time.Duration) *Poller {
+	return &Poller{
+		name:     name,
+		client:   client,
+		location: location,
+		filter:   filter,
+		interval: interval,
+		polled:   make(chan struct{}),
+	}
+}
+
+func (poller *Poller) Name() string {
+	return poller.name
+}
+
+func (poller *Poller) Client() SmartthingsClient {
+	return poller.client
+}
+
+// Run polls the account until the api is reachable, retrying with
+// backoff, and then every interval until ctx is done.
+func (poller *Poller) Run(ctx context.Context) {
+	if !poller.initialize(ctx) || poller.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(poller.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := poller.Poll(ctx); err != nil {
+			slog.Error("poll account failed", "account", poller.name, "error", err)
+		}
+	}
+}
+
+// initialize polls until the first success, it reports false when ctx is
+// done first.
+func (poller *Poller) initialize(ctx context.Context) bool {
+	backoff := initialBackoff
+	for {
+		_, err := poller.Poll(ctx)
+		if err == nil {
+			slog.Info("account initialized", "account", poller.name)
+			return true
+		}
+
+		switch {
+		case errors.Is(err, smartthings.ErrUnauthorized):
+			slog.Error("api token was rejected, check the token of the account", "account", poller.name, "error", err)
+		case errors.Is(err, smartthings.ErrNotAuthorized):
+			slog.Warn("account is not authorized yet, visit /oauth/login?account="+poller.name, "account", poller.name)
+		default:
+			slog.Warn("account initialization failed, retrying", "account", poller.name, "backoff", backoff, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Ready reports whether a poll of the account ever succeeded.
+func (poller *Poller) Ready() bool {
+	poller.mu.RLock()
+	defer poller.mu.RUnlock()
+	return poller.ready
+}
+
+// Polled is closed once the first poll finished, successful or not.
+func (poller *Poller) Polled() <-chan struct{} {
+	return poller.polled
+}
+
+// Snapshot returns the latest snapshot, polling first when the poller
+// isn't running in the background. When the last poll failed, the last
+// good snapshot is returned with the error, so a transient failure doesn't
+// drop the devices.
+func (poller *Poller) Snapshot(ctx context.Context) (*Snapshot, error) {
+	if poller.interval <= 0 {
+		if snapshot, err := poller.Poll(ctx); err == nil {
+			return snapshot, nil
+		}
+	}
+
+	poller.mu.RLock()
+	defer poller.mu.RUnlock()
+	if poller.snapshot == nil {
+		if poller.err != nil {
+			return nil, poller.err
+		}
+		return nil, errNotPolled
+	}
+	return poller.snapshot, poller.err
+}
+
+// LastSnapshot returns the latest snapshot without querying the api, only
+// an account polled on scrape that wasn't scraped yet is polled once.
+func (poller *Poller) LastSnapshot(ctx context.Context) (*Snapshot, error) {
+	if snapshot := poller.Status().Snapshot; snapshot != nil {
+		return snapshot, nil
+	}
+	return poller.Snapshot(ctx)
+}
+
+func (poller *Poller) Status() PollerStatus {
+	poller.mu.RLock()
+	defer poller.mu.RUnlock()
+
+	status := PollerStatus{
+		Account:  poller.name,
+		Interval: poller.interval,
+		Ready:    poller.ready,
+		LastPoll: poller.lastPoll,
+		Error:    poller.err,
+		Snapshot: poller.snapshot,
+	}
+	if poller.snapshot != nil {
+		status.LastSuccess = poller.snapshot.Time
+	}
+	return status
+}
+
+// Poll queries the api and stores the result as the latest snapshot, on
+// failure the previous snapshot is kept for Status.
+func (poller *Poller) Poll(ctx context.Context) (*Snapshot, error) {
+	snapshot, err := poller.poll(ctx)
+
+	poller.mu.Lock()
+	if poller.lastPoll.IsZero() {
+		close(poller.polled)
+	}
+	poller.lastPoll = time.Now()
+	if err != nil {
+		poller.err = err
+		poller.mu.Unlock()
+		return nil, err
+	}
+	poller.snapshot, poller.err, poller.ready = snapshot, nil, true
+	subscribers := poller.subscribers
+	poller.mu.Unlock()
+
+	notify(subscribers, snapshot)
+	return snapshot, nil
+}
+
+// Subscribe calls fn with every new snapshot, after a poll or an applied
+// event. It's called on the polling goroutine, so it must not block.
+func (poller *Poller) Subscribe(fn func(*Snapshot)) {
+	poller.mu.Lock()
+	defer poller.mu.Unlock()
+	poller.subscribers = append(poller.subscribers, fn)
+}
+
+func notify(subscribers []func(*Snapshot), snapshot *Snapshot) {
+	for _, fn := range subscribers {
+		fn(snapshot)
+	}
+}
+
+func (poller *Poller) poll(ctx context.Context) (*Snapshot, error) {
+	locationId, err := poller.resolveLocation(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := poller.client.ListDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Account: poller.name,
+		Time:    time.Now(),
+		Status:  make(map[string]map[string]smartthings.ComponentStatus),
+	}
+	poller.pollLocations(ctx, snapshot, locationId)
+
+	for _, device := range devices {
+		if locationId != "" && device.LocationID != locationId {
+			continue
+		}
+		if !poller.filter.Match(device) {
+			continue
+		}
+		snapshot.Devices = append(snapshot.Devices, device)
+
+		status := make(map[string]smartthings.ComponentStatus)
+		for _, component := range device.Components {
+			componentStatus, err := poller.client.GetDeviceComponentStatus(ctx, device.DeviceID, component.ID)
+			if err != nil {
+				slog.Error("getDeviceComponentStatus failed", "account", poller.name, "device_id", device.DeviceID, "component_id", component.ID, "error", err)
+				continue
+			}
+			status[component.ID] = componentStatus
+		}
+		snapshot.Status[device.DeviceID] = status
+	}
+
+	return snapshot, nil
+}
+
+// pollLocations adds the locations and rooms to the snapshot, they are
+// only used for names so failures aren't fatal.
+func (poller *Poller) pollLocations(ctx context.Context, snapshot *Snapshot, locationId string) {
+	locations, err := poller.client.ListLocations(ctx, nil)
+	if err != nil {
+		slog.Error("listLocations failed", "account", poller.name, "error", err)
+		return
+	}
+
+	for _, location := range locations {
+		if locationId != "" && location.ID != locationId {
+			continue
+		}
+		snapshot.Locations = append(snapshot.Locations, location)
+
+		rooms, err := poller.client.ListRooms(ctx, location.ID)
+		if err != nil {
+			slog.Error("listRooms failed", "account", poller.name, "location_id", location.ID, "error", err)
+			continue
+		}
+		snapshot.Rooms = append(snapshot.Rooms, rooms...)
+	}
+}
+
+func (poller *Poller) resolveLocation(ctx context.Context) (string, error) {
+	if poller.location == "" {
+		return "", nil
+	}
+
+	poller.mu.RLock()
+	locationId := poller.locationId
+	poller.mu.RUnlock()
+	if locationId != "" {
+		return locationId, nil
+	}
+
+	locationId, err := resolveLocation(ctx, poller.client, poller.location)
+	if err != nil {
+		return "", err
+	}
+
+	poller.mu.Lock()
+	poller.locationId = locationId
+	poller.mu.Unlock()
+	return locationId, nil
+}
+
+// limitedClient waits on a rate limiter before every api request.
+type limitedClient struct {
+	client  SmartthingsClient
+	limiter *rate.Limiter
+}
+
+// NewLimitedClient limits client to requestsPerSecond, a non-positive
+// limit disables limiting.
+func NewLimitedClient(client SmartthingsClient, requestsPerSecond float64) SmartthingsClient {
+	if requestsPerSecond <= 0 {
+		return client
+	}
+	return &limitedClient{
+		client:  client,
+		limiter: rate.NewLimiter(rate.Limit(requestsPerSecond), 1),
+	}
+}
+
+func (client *limitedClient) ListDevices(ctx context.Context) ([]*smartthings.Device, error) {
+	if err := client.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return client.client.ListDevices(ctx)
+}
+
+func (client *limitedClient) ListLocations(ctx context.Context, params url.Values) ([]*smartthings.Location, error) {
+	if err := client.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return client.client.ListLocations(ctx, params)
+}
+
+func (client *limitedClient) ListRooms(ctx context.Context, locationId string) ([]*smartthings.Room, error) {
+	if err := client.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return client.client.ListRooms(ctx, locationId)
+}
+
+func (client *limitedClient) GetDeviceComponentStatus(ctx context.Context, deviceId, componentId string) (smartthings.ComponentStatus, error) {
+	if err := client.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return client.client.GetDeviceComponentStatus(ctx, deviceId, componentId)
+}
+
+// ApplyEvent updates the latest snapshot with a pushed device event. It
+// reports false when the device isn't part of the snapshot.
+func (poller *Poller) ApplyEvent(event *smartthings.DeviceEvent) bool {
+	poller.mu.Lock()
+	if poller.snapshot == nil {
+		poller.mu.Unlock()
+		return false
+	}
+	status, ok := poller.snapshot.Status[event.DeviceID]
+	if !ok {
+		poller.mu.Unlock()
+		return false
+	}
+
+	// snapshots are shared with running collections, so copy on write
+	snapshot := *poller.snapshot
+	snapshot.Status = make(map[string]map[string]smartthings.ComponentStatus, len(poller.snapshot.Status))
+	for deviceId, deviceStatus := range poller.snapshot.Status {
+		snapshot.Status[deviceId] = deviceStatus
+	}
+	snapshot.Status[event.DeviceID] = applyDeviceEvent(status, event)
+	poller.snapshot = &snapshot
+	subscribers := poller.subscribers
+	poller.mu.Unlock()
+
+	notify(subscribers, &snapshot)
+	return true
+}
+
+func applyDeviceEvent(status map[string]smartthings.ComponentStatus, event *smartthings.DeviceEvent) map[string]smartthings.ComponentStatus {
+	updated := make(map[string]smartthings.ComponentStatus, len(status)+1)
+	for componentId, componentStatus := range status {
+		updated[componentId] = componentStatus
+	}
+
+	component := make(smartthings.ComponentStatus)
+	for capabilityId, attributes := range status[event.ComponentID] {
+		component[capabilityId] = attributes
+	}
+
+	attributes := make(smartthings.ComponentAttributes)
+	for attributeId, properties := range component[event.Capability] {
+		attributes[attributeId] = properties
+	}
+
+	properties := make(smartthings.ComponentProperties)
+	for name, value := range attributes[event.Attribute] {
+		properties[name] = value
+	}
+	properties["value"] = event.Value
+	// events don't have a timestamp, the attribute changed about now
+	properties["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	if event.Data != nil {
+		properties["data"] = event.Data
+	}
+
+	attributes[event.Attribute] = properties
+	component[event.Capability] = attributes
+	updated[event.ComponentID] = component
+	return updated
+}
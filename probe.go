@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ProbeHandler serves metrics for a single target per request, in the
+// style of the blackbox exporter: /probe?target=<account-or-location>.
+// A room is probed with a target of <location>/<room>.
+type ProbeHandler struct {
+	pollers []*Poller
+}
+
+func NewProbeHandler(pollers ...*Poller) *ProbeHandler {
+	return &ProbeHandler{pollers: pollers}
+}
+
+func (handler *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("target")
+	if name == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	collector, err := handler.collector(r.Context(), name)
+	if err != nil {
+		slog.Error("probe target failed", "target", name, "error", err)
+		http.Error(w, fmt.Sprintf("unknown target %q", name), http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// collector scopes a collector to the account named target, or otherwise
+// to the first account that has a location with target as id or name.
+func (handler *ProbeHandler) collector(ctx context.Context, target string) (*Collector, error) {
+	for _, poller := range handler.pollers {
+		if poller.Name() == target {
+			return NewCollector(poller), nil
+		}
+	}
+
+	location, room, _ := strings.Cut(target, "/")
+	err := fmt.Errorf("no account or location %s", target)
+	for _, poller := range handler.pollers {
+		// resolved with the last poll, so probes don't use the api quota
+		snapshot, snapshotErr := poller.LastSnapshot(ctx)
+		if snapshot == nil {
+			err = snapshotErr
+			continue
+		}
+		l := snapshot.FindLocation(location)
+		if l == nil {
+			err = fmt.Errorf("location %s not found", location)
+			continue
+		}
+		var roomId string
+		if room != "" {
+			r := snapshot.FindRoom(l.ID, room)
+			if r == nil {
+				err = fmt.Errorf("room %s not found in location %s", room, l.ID)
+				continue
+			}
+			roomId = r.ID
+		}
+		return NewLocationCollector(poller, l.ID, roomId), nil
+	}
+
+	return nil, err
+}
+
+// resolveLocation maps a location id or name to the location id.
+func resolveLocation(ctx context.Context, client SmartthingsClient, location string) (string, error) {
+	if location == "" {
+		return "", nil
+	}
+
+	locations, err := client.ListLocations(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for _, l := range locations {
+		if l.ID == location || strings.EqualFold(l.Name, location) {
+			return l.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("location %s not found", location)
+}
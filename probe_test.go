@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeHandler(t *testing.T) {
+	client := &fakeClient{
+		locations: []*smartthings.Location{
+			{ID: "loc-1", Name: "Home"},
+			{ID: "loc-2", Name: "Cabin"},
+		},
+		rooms: []*smartthings.Room{
+			{ID: "room-1", LocationID: "loc-1", Name: "Hallway"},
+			{ID: "room-2", LocationID: "loc-1", Name: "Kitchen"},
+		},
+		devices: []*smartthings.Device{
+			{DeviceID: "dev-1", Label: "front door", LocationID: "loc-1", RoomID: "room-1"},
+			{DeviceID: "dev-3", Label: "fridge", LocationID: "loc-1", RoomID: "room-2"},
+			{DeviceID: "dev-2", Label: "porch light", LocationID: "loc-2"},
+		},
+	}
+	handler := NewProbeHandler(
+		NewPoller(defaultAccount, client, "", DeviceFilter{}, 0),
+		NewPoller("cabin", client, "Cabin", DeviceFilter{}, 0),
+		NewPoller("broken", &fakeClient{err: errors.New("unauthorized")}, "", DeviceFilter{}, 0),
+	)
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		contains   []string
+		excludes   []string
+	}{
+		{"missing target", "", http.StatusBadRequest, nil, nil},
+		{"unknown location", "nowhere", http.StatusBadRequest, nil, nil},
+		{"location by name", "home", http.StatusOK,
+			[]string{`deviceId="dev-1"`, `smartthings_up{account="default"} 1`}, []string{`deviceId="dev-2"`}},
+		{"location by id", "loc-2", http.StatusOK,
+			[]string{`deviceId="dev-2"`}, []string{`deviceId="dev-1"`}},
+		{"room by name", "home/kitchen", http.StatusOK,
+			[]string{`deviceId="dev-3"`}, []string{`deviceId="dev-1"`, `deviceId="dev-2"`}},
+		{"room by id", "loc-1/room-1", http.StatusOK,
+			[]string{`deviceId="dev-1"`}, []string{`deviceId="dev-2"`, `deviceId="dev-3"`}},
+		{"unknown room", "home/attic", http.StatusBadRequest, nil, nil},
+		{"named target", "cabin", http.StatusOK,
+			[]string{`deviceId="dev-2"`}, []string{`deviceId="dev-1"`}},
+		{"failing target", "broken", http.StatusOK,
+			[]string{`smartthings_up{account="broken"} 0`}, []string{"smartthings_device{"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/probe?target="+test.target, nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.wantStatus, rec.Code)
+			body, _ := io.ReadAll(rec.Body)
+			for _, s := range test.contains {
+				assert.Contains(t, string(body), s)
+			}
+			for _, s := range test.excludes {
+				assert.NotContains(t, string(body), s)
+			}
+		})
+	}
+}
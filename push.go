@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteRetries is how often a failed remote write is retried within
+// a push, with a doubling backoff.
+const remoteWriteRetries = 3
+
+var remoteWriteBackoff = time.Second
+
+// Pusher pushes the collected metrics somewhere.
+type Pusher interface {
+	Push(ctx context.Context) error
+}
+
+// PushAuth authenticates the pushes, with basic auth when Username is set
+// or else with BearerToken when set.
+type PushAuth struct {
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+func (auth PushAuth) header() http.Header {
+	header := make(http.Header)
+	if auth.Username == "" && auth.BearerToken != "" {
+		header.Set("Authorization", "Bearer "+auth.BearerToken)
+	}
+	return header
+}
+
+// runPush pushes every interval until ctx is done, the first push is after
+// an interval so the pollers had time to initialize.
+func runPush(ctx context.Context, interval time.Duration, pushers ...Pusher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, pusher := range pushers {
+			if err := pusher.Push(ctx); err != nil {
+				slog.Error("pushing metrics failed", "error", err)
+			}
+		}
+	}
+}
+
+// Pushgateway pushes the metrics to a pushgateway, grouped by account and
+// location, every push replaces the metrics of its group.
+type Pushgateway struct {
+	url     string
+	job     string
+	auth    PushAuth
+	client  *http.Client
+	pollers []*Poller
+}
+
+func NewPushgateway(url, job string, auth PushAuth, client *http.Client, pollers ...*Poller) *Pushgateway {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Pushgateway{url: url, job: job, auth: auth, client: client, pollers: pollers}
+}
+
+func (gateway *Pushgateway) Push(ctx context.Context) error {
+	var errs []error
+	for _, poller := range gateway.pollers {
+		if err := gateway.pushAccount(ctx, poller); err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", poller.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pushAccount pushes a group per location of the account. After a failed
+// poll the last snapshot is pushed with smartthings_up 0, so the groups
+// don't keep reporting the account as up.
+func (gateway *Pushgateway) pushAccount(ctx context.Context, poller *Poller) error {
+	account := poller.Name()
+	snapshot, err := poller.Snapshot(ctx)
+	if err != nil {
+		slog.Error("collect account failed", "account", account, "error", err)
+	}
+
+	locations := snapshotLocations(snapshot)
+	if len(locations) == 0 {
+		collector := &snapshotCollector{account: account, snapshot: snapshot, err: err}
+		return gateway.pusher(collector).Grouping("account", account).PushContext(ctx)
+	}
+	var errs []error
+	for _, locationId := range locations {
+		collector := &snapshotCollector{account: account, snapshot: snapshot, err: err, location: locationId}
+		pushErr := gateway.pusher(collector).
+			Grouping("account", account).
+			Grouping("location", locationId).
+			PushContext(ctx)
+		if pushErr != nil {
+			errs = append(errs, fmt.Errorf("location %s: %w", locationId, pushErr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// snapshotLocations returns the ids of the locations of the snapshot and
+// of its devices, sorted.
+func snapshotLocations(snapshot *Snapshot) []string {
+	if snapshot == nil {
+		return nil
+	}
+	locations := make(map[string]bool)
+	for _, location := range snapshot.Locations {
+		locations[location.ID] = true
+	}
+	for _, device := range snapshot.Devices {
+		if device.LocationID != "" {
+			locations[device.LocationID] = true
+		}
+	}
+	return sortedKeys(locations)
+}
+
+func (gateway *Pushgateway) pusher(collector prometheus.Collector) *push.Pusher {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	// the pushgateway adds the grouping labels back to the metrics
+	pusher := push.New(gateway.url, gateway.job).
+		Gatherer(&withoutLabels{gatherer: registry, names: []string{"account"}}).
+		Client(gateway.client).
+		Header(gateway.auth.header()).
+		Format(expfmt.NewFormat(expfmt.TypeTextPlain))
+	if gateway.auth.Username != "" {
+		pusher.BasicAuth(gateway.auth.Username, gateway.auth.Password)
+	}
+	return pusher
+}
+
+// withoutLabels drops labels from the gathered metrics.
+type withoutLabels struct {
+	gatherer prometheus.Gatherer
+	names    []string
+}
+
+func (gatherer *withoutLabels) Gather() ([]*dto.MetricFamily, error) {
+	families, err := gatherer.gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := metric.Label[:0]
+			for _, label := range metric.GetLabel() {
+				if !gatherer.drop(label.GetName()) {
+					labels = append(labels, label)
+				}
+			}
+			metric.Label = labels
+		}
+	}
+	return families, err
+}
+
+func (gatherer *withoutLabels) drop(name string) bool {
+	for _, dropped := range gatherer.names {
+		if name == dropped {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteWriter pushes the metrics with the prometheus remote write
+// protocol, as snappy compressed protobuf.
+type RemoteWriter struct {
+	url      string
+	auth     PushAuth
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	now      func() time.Time
+}
+
+func NewRemoteWriter(url string, auth PushAuth, client *http.Client, pollers ...*Poller) *RemoteWriter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(pollers...))
+	return &RemoteWriter{url: url, auth: auth, client: client, gatherer: registry, now: time.Now}
+}
+
+func (writer *RemoteWriter) Push(ctx context.Context) error {
+	families, err := writer.gatherer.Gather()
+	if err != nil {
+		// the metrics that could be gathered are still written
+		slog.Warn("gathering metrics for remote write failed", "error", err)
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(families, writer.now().UnixMilli()))
+
+	backoff := remoteWriteBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := writer.write(ctx, body)
+		if err == nil || !retry || attempt == remoteWriteRetries {
+			return err
+		}
+		slog.Warn("remote write failed, retrying", "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// write sends a request, it reports whether a failure is worth a retry.
+func (writer *RemoteWriter) write(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, writer.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = writer.auth.header()
+	if writer.auth.Username != "" {
+		req.SetBasicAuth(writer.auth.Username, writer.auth.Password)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "smartthings-exporter/"+Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := writer.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("unexpected status code %d while writing to %s: %s", resp.StatusCode, writer.url, bytes.TrimSpace(message))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// encodeWriteRequest encodes the gauges, counters and untyped metrics of
+// families as a prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(families []*dto.MetricFamily, timestamp int64) []byte {
+	var request []byte
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var value float64
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				value = metric.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = metric.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = metric.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			labels := map[string]string{"__name__": family.GetName()}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			names := make([]string, 0, len(labels))
+			for name := range labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			var series []byte
+			for _, name := range names {
+				var label []byte
+				label = protowire.AppendTag(label, 1, protowire.BytesType)
+				label = protowire.AppendString(label, name)
+				label = protowire.AppendTag(label, 2, protowire.BytesType)
+				label = protowire.AppendString(label, labels[name])
+
+				series = protowire.AppendTag(series, 1, protowire.BytesType)
+				series = protowire.AppendBytes(series, label)
+			}
+
+			sampleTimestamp := timestamp
+			if metric.TimestampMs != nil {
+				sampleTimestamp = metric.GetTimestampMs()
+			}
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(sampleTimestamp))
+
+			series = protowire.AppendTag(series, 2, protowire.BytesType)
+			series = protowire.AppendBytes(series, sample)
+
+			request = protowire.AppendTag(request, 1, protowire.BytesType)
+			request = protowire.AppendBytes(request, series)
+		}
+	}
+	return request
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestPushgateway(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	poller := NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0)
+	gateway := NewPushgateway(recorder.URL, "smartthings", PushAuth{Username: "user", Password: "secret"}, nil, poller)
+	require.NoError(t, gateway.Push(context.Background()))
+
+	require.Len(t, recorder.requests, 2)
+	// the order of the grouping labels in the path isn't fixed
+	group := func(location string) *recordedRequest {
+		for _, push := range recorder.requests {
+			if strings.HasPrefix(push.path, "/metrics/job/smartthings/") &&
+				strings.Contains(push.path+"/", "/account/home/") && strings.Contains(push.path+"/", "/location/"+location+"/") {
+				return push
+			}
+		}
+		return nil
+	}
+
+	first := group("loc-1")
+	require.NotNil(t, first)
+	assert.Equal(t, http.MethodPut, first.method)
+	username, password, ok := (&http.Request{Header: first.header}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "secret", password)
+
+	// the grouping labels are added back by the pushgateway
+	assert.Contains(t, string(first.body), `smartthings_attribute_switch{componentId="switch",deviceId="dev-1"} 1`)
+	assert.NotContains(t, string(first.body), "dev-2")
+	assert.NotContains(t, string(first.body), "account=")
+
+	second := group("loc-2")
+	require.NotNil(t, second)
+	assert.Contains(t, string(second.body), `deviceId="dev-2"`)
+}
+
+func TestPushgatewayWithoutLocations(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	client := fixtureClient()
+	client.locations = nil
+	for _, device := range client.devices {
+		device.LocationID = ""
+	}
+	gateway := NewPushgateway(recorder.URL, "smartthings", PushAuth{BearerToken: "token"}, nil, NewPoller("home", client, "", DeviceFilter{}, 0))
+	require.NoError(t, gateway.Push(context.Background()))
+
+	require.Len(t, recorder.requests, 1)
+	assert.Equal(t, "/metrics/job/smartthings/account/home", recorder.requests[0].path)
+	assert.Equal(t, "Bearer token", recorder.requests[0].header.Get("Authorization"))
+}
+
+func TestPushgatewayFailure(t *testing.T) {
+	recorder := newHTTPRecorder(t, http.StatusInternalServerError)
+
+	gateway := NewPushgateway(recorder.URL, "smartthings", PushAuth{}, nil, NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0))
+	assert.ErrorContains(t, gateway.Push(context.Background()), "account home: location loc-1: unexpected status code 500")
+}
+
+func TestPushgatewayLastSnapshot(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	// the cabin isn't listed, its devices are still pushed
+	client := fixtureClient()
+	client.locations = client.locations[:1]
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Minute)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+	gateway := NewPushgateway(recorder.URL, "smartthings", PushAuth{}, nil, poller)
+
+	client.err = errors.New("unavailable")
+	_, err = poller.Poll(context.Background())
+	require.Error(t, err)
+	require.NoError(t, gateway.Push(context.Background()))
+
+	require.Len(t, recorder.requests, 2)
+	for _, push := range recorder.requests {
+		assert.Contains(t, string(push.body), "smartthings_up 0", push.path)
+	}
+	assert.Contains(t, recorder.requests[0].path, "/location/loc-1")
+	assert.Contains(t, string(recorder.requests[0].body), `deviceId="dev-1"`)
+	assert.Contains(t, recorder.requests[1].path, "/location/loc-2")
+	assert.Contains(t, string(recorder.requests[1].body), `deviceId="dev-2"`)
+}
+
+type writtenSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the fields of a prometheus.WriteRequest used by encodeWriteRequest.
+func decodeWriteRequest(t *testing.T, data []byte) []*writtenSeries {
+	fields := func(data []byte, field func(num protowire.Number, typ protowire.Type, value []byte, scalar uint64)) {
+		for len(data) > 0 {
+			num, typ, n := protowire.ConsumeTag(data)
+			require.GreaterOrEqual(t, n, 0)
+			data = data[n:]
+			switch typ {
+			case protowire.BytesType:
+				value, n := protowire.ConsumeBytes(data)
+				require.GreaterOrEqual(t, n, 0)
+				field(num, typ, value, 0)
+				data = data[n:]
+			case protowire.VarintType:
+				value, n := protowire.ConsumeVarint(data)
+				require.GreaterOrEqual(t, n, 0)
+				field(num, typ, nil, value)
+				data = data[n:]
+			case protowire.Fixed64Type:
+				value, n := protowire.ConsumeFixed64(data)
+				require.GreaterOrEqual(t, n, 0)
+				field(num, typ, nil, value)
+				data = data[n:]
+			default:
+				t.Fatalf("unexpected wire type %d", typ)
+			}
+		}
+	}
+
+	var series []*writtenSeries
+	fields(data, func(num protowire.Number, _ protowire.Type, timeseries []byte, _ uint64) {
+		require.Equal(t, protowire.Number(1), num)
+		s := &writtenSeries{labels: map[string]string{}}
+		fields(timeseries, func(num protowire.Number, _ protowire.Type, message []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				fields(message, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				s.labels[name] = value
+			case 2:
+				fields(message, func(num protowire.Number, _ protowire.Type, _ []byte, scalar uint64) {
+					if num == 1 {
+						s.value = math.Float64frombits(scalar)
+					} else {
+						s.timestamp = int64(scalar)
+					}
+				})
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+func TestRemoteWriter(t *testing.T) {
+	recorder := newHTTPRecorder(t, http.StatusNoContent)
+
+	writer := NewRemoteWriter(recorder.URL+"/api/v1/write", PushAuth{BearerToken: "token"}, nil,
+		NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0))
+	now := time.UnixMilli(1700000000000)
+	writer.now = func() time.Time { return now }
+	require.NoError(t, writer.Push(context.Background()))
+
+	require.Len(t, recorder.requests, 1)
+	push := recorder.requests[0]
+	assert.Equal(t, http.MethodPost, push.method)
+	assert.Equal(t, "/api/v1/write", push.path)
+	assert.Equal(t, "Bearer token", push.header.Get("Authorization"))
+	assert.Equal(t, "snappy", push.header.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", push.header.Get("Content-Type"))
+	assert.Equal(t, "0.1.0", push.header.Get("X-Prometheus-Remote-Write-Version"))
+
+	data, err := snappy.Decode(nil, push.body)
+	require.NoError(t, err)
+	series := decodeWriteRequest(t, data)
+
+	byName := make(map[string][]*writtenSeries)
+	for _, s := range series {
+		assert.Equal(t, now.UnixMilli(), s.timestamp)
+		byName[s.labels["__name__"]] = append(byName[s.labels["__name__"]], s)
+	}
+	require.Len(t, byName["smartthings_up"], 1)
+	assert.Equal(t, map[string]string{"__name__": "smartthings_up", "account": "home"}, byName["smartthings_up"][0].labels)
+	assert.Equal(t, float64(1), byName["smartthings_up"][0].value)
+
+	require.Len(t, byName["smartthings_attribute_contact"], 1)
+	contact := byName["smartthings_attribute_contact"][0]
+	assert.Equal(t, "open", contact.labels["state"])
+	assert.Equal(t, "dev-2", contact.labels["deviceId"])
+	assert.Equal(t, float64(0), contact.value)
+	assert.Len(t, byName["smartthings_device"], 2)
+}
+
+func TestRemoteWriterRetries(t *testing.T) {
+	defer func(backoff time.Duration) { remoteWriteBackoff = backoff }(remoteWriteBackoff)
+	remoteWriteBackoff = time.Millisecond
+
+	recorder := newHTTPRecorder(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	writer := NewRemoteWriter(recorder.URL, PushAuth{Username: "user", Password: "secret"}, nil,
+		NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0))
+	require.NoError(t, writer.Push(context.Background()))
+	assert.Len(t, recorder.requests, 3)
+
+	// client errors aren't retried
+	recorder.requests, recorder.statuses = nil, []int{http.StatusBadRequest}
+	err := writer.Push(context.Background())
+	assert.ErrorContains(t, err, "unexpected status code 400")
+	assert.Len(t, recorder.requests, 1)
+}
+
+func TestRunPush(t *testing.T) {
+	recorder := newHTTPRecorder(t)
+
+	writer := NewRemoteWriter(recorder.URL, PushAuth{}, nil, NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runPush(ctx, 10*time.Millisecond, writer)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return len(recorder.requests) >= 2
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
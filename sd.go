@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// TargetGroup is a target group in the prometheus http_sd_config format.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ServiceDiscoveryHandler lists the locations of every account as probe
+// targets for prometheus http service discovery. Rooms are listed as
+// <location>/<room> targets as well with ?rooms=true.
+type ServiceDiscoveryHandler struct {
+	pollers []*Poller
+}
+
+func NewServiceDiscoveryHandler(pollers ...*Poller) *ServiceDiscoveryHandler {
+	return &ServiceDiscoveryHandler{pollers: pollers}
+}
+
+func (handler *ServiceDiscoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	withRooms, _ := strconv.ParseBool(r.URL.Query().Get("rooms"))
+
+	groups := make([]*TargetGroup, 0)
+	for _, poller := range handler.pollers {
+		// the locations and rooms of the last poll, so discovery doesn't use the api quota
+		snapshot, err := poller.LastSnapshot(r.Context())
+		if err != nil && snapshot == nil {
+			// a failing account is left out instead of failing the whole discovery
+			slog.Error("service discovery failed", "account", poller.Name(), "error", err)
+			continue
+		}
+
+		for _, location := range snapshot.Locations {
+			labels := map[string]string{
+				"__meta_smartthings_account":       poller.Name(),
+				"__meta_smartthings_location_id":   location.ID,
+				"__meta_smartthings_location_name": location.Name,
+				"__meta_smartthings_country_code":  location.CountryCode,
+				"__meta_smartthings_time_zone":     location.TimeZoneID,
+			}
+			groups = append(groups, &TargetGroup{Targets: []string{location.ID}, Labels: labels})
+
+			if !withRooms {
+				continue
+			}
+			for _, room := range snapshot.Rooms {
+				if room.LocationID != location.ID {
+					continue
+				}
+				roomLabels := map[string]string{
+					"__meta_smartthings_room_id":   room.ID,
+					"__meta_smartthings_room_name": room.Name,
+				}
+				for k, v := range labels {
+					roomLabels[k] = v
+				}
+				groups = append(groups, &TargetGroup{Targets: []string{location.ID + "/" + room.ID}, Labels: roomLabels})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		slog.Warn("responding to service discovery request failed", "error", err)
+	}
+}
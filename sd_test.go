@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceDiscoveryHandler(t *testing.T) {
+	client := &fakeClient{
+		locations: []*smartthings.Location{
+			{ID: "loc-1", Name: "Home", CountryCode: "USA", TimeZoneID: "America/Los_Angeles"},
+		},
+		rooms: []*smartthings.Room{
+			{ID: "room-1", LocationID: "loc-1", Name: "Hallway"},
+		},
+	}
+	handler := NewServiceDiscoveryHandler(
+		NewPoller("home", client, "", DeviceFilter{}, 0),
+		NewPoller("broken", &fakeClient{err: errors.New("unauthorized")}, "", DeviceFilter{}, 0),
+	)
+
+	discover := func(query string) []*TargetGroup {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sd"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var groups []*TargetGroup
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&groups))
+		return groups
+	}
+
+	groups := discover("")
+	require.Len(t, groups, 1)
+	assert.Equal(t, []string{"loc-1"}, groups[0].Targets)
+	assert.Equal(t, map[string]string{
+		"__meta_smartthings_account":       "home",
+		"__meta_smartthings_location_id":   "loc-1",
+		"__meta_smartthings_location_name": "Home",
+		"__meta_smartthings_country_code":  "USA",
+		"__meta_smartthings_time_zone":     "America/Los_Angeles",
+	}, groups[0].Labels)
+
+	groups = discover("?rooms=true")
+	require.Len(t, groups, 2)
+	assert.Equal(t, []string{"loc-1/room-1"}, groups[1].Targets)
+	assert.Equal(t, "Hallway", groups[1].Labels["__meta_smartthings_room_name"])
+	assert.Equal(t, "Home", groups[1].Labels["__meta_smartthings_location_name"])
+}
+
+func TestServiceDiscoveryHandlerUsesSnapshot(t *testing.T) {
+	client := &fakeClient{
+		locations: []*smartthings.Location{{ID: "loc-1", Name: "Home"}},
+		rooms:     []*smartthings.Room{{ID: "room-1", LocationID: "loc-1", Name: "Hallway"}},
+	}
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Minute)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+	client.err = errors.New("unavailable")
+	_, err = poller.Poll(context.Background())
+	require.Error(t, err)
+
+	rec := httptest.NewRecorder()
+	NewServiceDiscoveryHandler(poller).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sd?rooms=true", nil))
+	var groups []*TargetGroup
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&groups))
+	require.Len(t, groups, 2, "the targets of the last poll are served while the api fails")
+	assert.Equal(t, []string{"loc-1/room-1"}, groups[1].Targets)
+
+	rec = httptest.NewRecorder()
+	NewProbeHandler(poller).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target=home/hallway", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `smartthings_up{account="home"} 0`)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// serve runs listenAndServe until ctx is done, then stops accepting
+// connections and waits up to gracePeriod for in-flight requests before
+// closing the remaining connections.
+func serve(ctx context.Context, server *http.Server, gracePeriod time.Duration, listenAndServe func() error) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, draining in-flight requests", "grace_period", gracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("graceful shutdown failed, closing connections", "error", err)
+		_ = server.Close()
+	}
+
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+// maxSimulationStep limits how far the simulation advances at once, so a
+// long pause between polls doesn't change every device.
+const maxSimulationStep = time.Hour
+
+var simulatedRoomNames = []string{"Living Room", "Kitchen", "Bedroom", "Bathroom", "Hallway", "Office", "Garage", "Basement"}
+
+// simulatedKinds are assigned to the devices of a room in turn.
+var simulatedKinds = []string{"temperature", "motion", "contact", "plug", "lock"}
+
+// SimulatorConfig sizes the simulated account.
+type SimulatorConfig struct {
+	Homes   int
+	Rooms   int // per home
+	Devices int // per room
+	Seed    uint64
+}
+
+// Simulator is a SmartthingsClient of virtual homes, rooms and devices
+// whose values drift with time: temperatures wander, motion fires, doors
+// open and close and energy counters climb. Every poll advances the
+// simulation by the time passed since the previous one.
+type Simulator struct {
+	mu        sync.Mutex
+	rand      *rand.Rand
+	now       func() time.Time
+	last      time.Time
+	locations []*smartthings.Location
+	rooms     []*smartthings.Room
+	devices   []*simulatedDevice
+	byId      map[string]*simulatedDevice
+}
+
+type simulatedDevice struct {
+	kind    string
+	device  *smartthings.Device
+	created time.Time
+	changed map[string]time.Time // by attribute
+
+	temperature float64
+	humidity    float64
+	battery     float64
+	power       float64
+	energy      float64
+	on          bool
+	open        bool
+	locked      bool
+	motionUntil time.Time
+}
+
+func NewSimulator(config SimulatorConfig) *Simulator {
+	return newSimulator(config, time.Now)
+}
+
+func newSimulator(config SimulatorConfig, now func() time.Time) *Simulator {
+	seed := config.Seed
+	if seed == 0 {
+		seed = uint64(now().UnixNano())
+	}
+	simulator := &Simulator{
+		rand: rand.New(rand.NewPCG(seed, seed)),
+		now:  now,
+		last: now(),
+		byId: make(map[string]*simulatedDevice),
+	}
+
+	ids := 0
+	nextId := func() string {
+		ids++
+		return fmt.Sprintf("00000000-0000-4000-8000-%012x", ids)
+	}
+	for h := 1; h <= config.Homes; h++ {
+		location := &smartthings.Location{
+			ID:               nextId(),
+			Name:             fmt.Sprintf("Home %d", h),
+			CountryCode:      "USA",
+			TemperatureScale: "C",
+			TimeZoneID:       "UTC",
+			Locale:           "en",
+		}
+		simulator.locations = append(simulator.locations, location)
+
+		for r := 0; r < config.Rooms; r++ {
+			name := simulatedRoomNames[r%len(simulatedRoomNames)]
+			if r >= len(simulatedRoomNames) {
+				name = fmt.Sprintf("%s %d", name, r/len(simulatedRoomNames)+1)
+			}
+			room := &smartthings.Room{ID: nextId(), LocationID: location.ID, Name: name}
+			simulator.rooms = append(simulator.rooms, room)
+
+			for d := 0; d < config.Devices; d++ {
+				kind := simulatedKinds[d%len(simulatedKinds)]
+				device := simulator.newDevice(nextId(), kind, location, room, d/len(simulatedKinds)+1)
+				simulator.devices = append(simulator.devices, device)
+				simulator.byId[device.device.DeviceID] = device
+			}
+		}
+	}
+	return simulator
+}
+
+func (simulator *Simulator) newDevice(id, kind string, location *smartthings.Location, room *smartthings.Room, n int) *simulatedDevice {
+	capabilities := map[string][]string{
+		"temperature": {"temperatureMeasurement", "relativeHumidityMeasurement", "battery"},
+		"motion":      {"motionSensor", "temperatureMeasurement", "battery"},
+		"contact":     {"contactSensor", "battery"},
+		"plug":        {"switch", "powerMeter", "energyMeter"},
+		"lock":        {"lock", "battery"},
+	}[kind]
+	component := &smartthings.Component{ID: "main", Label: "main"}
+	for _, capability := range capabilities {
+		component.Capabilities = append(component.Capabilities, &smartthings.Capability{ID: capability, Version: 1})
+	}
+
+	label := fmt.Sprintf("%s %s", room.Name, kind)
+	if n > 1 {
+		label = fmt.Sprintf("%s %d", label, n)
+	}
+	now := simulator.now()
+	return &simulatedDevice{
+		kind: kind,
+		device: &smartthings.Device{
+			DeviceID:          id,
+			Name:              "simulated-" + kind,
+			Label:             label,
+			ManufacturerName:  "smartthings-exporter",
+			LocationID:        location.ID,
+			RoomID:            room.ID,
+			DeviceTypeName:    "Simulated " + kind,
+			DeviceNetworkType: "VIRTUAL",
+			Components:        []*smartthings.Component{component},
+		},
+		created:     now,
+		changed:     map[string]time.Time{},
+		temperature: 18 + simulator.rand.Float64()*6,
+		humidity:    35 + simulator.rand.Float64()*20,
+		battery:     50 + simulator.rand.Float64()*50,
+		on:          simulator.rand.IntN(2) == 0,
+		locked:      true,
+		energy:      simulator.rand.Float64() * 100,
+		motionUntil: now,
+	}
+}
+
+// advance moves the simulation to now.
+func (simulator *Simulator) advance() {
+	now := simulator.now()
+	step := min(now.Sub(simulator.last), maxSimulationStep)
+	simulator.last = now
+	if step <= 0 {
+		return
+	}
+	for _, device := range simulator.devices {
+		simulator.step(device, now, step)
+	}
+}
+
+// step advances a device by d, events happen at random with the given mean
+// interval.
+func (simulator *Simulator) step(device *simulatedDevice, now time.Time, d time.Duration) {
+	minutes := d.Minutes()
+	happens := func(mean time.Duration) bool {
+		return simulator.rand.Float64() < 1-math.Exp(-d.Seconds()/mean.Seconds())
+	}
+	wander := func(value, target, spread float64) float64 {
+		// reverts to the target with a random walk on top
+		value += (target-value)*min(1, minutes/60) + simulator.rand.NormFloat64()*spread*math.Sqrt(minutes)
+		return math.Round(value*10) / 10
+	}
+	changed := func(attributes ...string) {
+		for _, attribute := range attributes {
+			device.changed[attribute] = now
+		}
+	}
+
+	// a day is warmer in the afternoon
+	daily := 20 + 2*math.Sin(2*math.Pi*(float64(now.Hour())+float64(now.Minute())/60-9)/24)
+	switch device.kind {
+	case "temperature":
+		device.temperature = wander(device.temperature, daily, 0.1)
+		device.humidity = max(0, min(100, wander(device.humidity, 45, 0.3)))
+		changed("temperature", "humidity")
+	case "motion":
+		device.temperature = wander(device.temperature, daily, 0.1)
+		changed("temperature")
+		active := now.Before(device.motionUntil)
+		if happens(10 * time.Minute) {
+			device.motionUntil = now.Add(time.Minute)
+		}
+		if now.Before(device.motionUntil) != active {
+			changed("motion")
+		}
+	case "contact":
+		if happens(30 * time.Minute) {
+			device.open = !device.open
+			changed("contact")
+		}
+	case "plug":
+		if happens(2 * time.Hour) {
+			device.on = !device.on
+			changed("switch")
+		}
+		device.power = 0
+		if device.on {
+			device.power = math.Round((40+simulator.rand.NormFloat64()*5)*10) / 10
+		}
+		device.energy += device.power * d.Hours() / 1000
+		changed("power", "energy")
+	case "lock":
+		if happens(time.Hour) {
+			device.locked = !device.locked
+			changed("lock")
+		}
+	}
+
+	if device.kind != "plug" {
+		// about a percent a day, until the battery is replaced
+		if device.battery -= d.Hours() / 24; device.battery < 5 {
+			device.battery = 100
+		}
+		changed("battery")
+	}
+}
+
+func (simulator *Simulator) status(device *simulatedDevice) smartthings.ComponentStatus {
+	attribute := func(name string, value interface{}, unit string) smartthings.ComponentAttributes {
+		properties := smartthings.ComponentProperties{"value": value}
+		if unit != "" {
+			properties["unit"] = unit
+		}
+		changed, ok := device.changed[name]
+		if !ok {
+			changed = device.created
+		}
+		properties["timestamp"] = changed.UTC().Format("2006-01-02T15:04:05.000Z")
+		return smartthings.ComponentAttributes{name: properties}
+	}
+	battery := attribute("battery", math.Round(device.battery), "%")
+	states := func(on bool, yes, no string) string {
+		if on {
+			return yes
+		}
+		return no
+	}
+
+	switch device.kind {
+	case "temperature":
+		return smartthings.ComponentStatus{
+			"temperatureMeasurement":      attribute("temperature", device.temperature, "C"),
+			"relativeHumidityMeasurement": attribute("humidity", device.humidity, "%"),
+			"battery":                     battery,
+		}
+	case "motion":
+		return smartthings.ComponentStatus{
+			"motionSensor":           attribute("motion", states(simulator.now().Before(device.motionUntil), "active", "inactive"), ""),
+			"temperatureMeasurement": attribute("temperature", device.temperature, "C"),
+			"battery":                battery,
+		}
+	case "contact":
+		return smartthings.ComponentStatus{
+			"contactSensor": attribute("contact", states(device.open, "open", "closed"), ""),
+			"battery":       battery,
+		}
+	case "plug":
+		return smartthings.ComponentStatus{
+			"switch":      attribute("switch", states(device.on, "on", "off"), ""),
+			"powerMeter":  attribute("power", device.power, "W"),
+			"energyMeter": attribute("energy", math.Round(device.energy*1000)/1000, "kWh"),
+		}
+	case "lock":
+		return smartthings.ComponentStatus{
+			"lock":    attribute("lock", states(device.locked, "locked", "unlocked"), ""),
+			"battery": battery,
+		}
+	}
+	return smartthings.ComponentStatus{}
+}
+
+// ListDevices starts a poll, so it advances the simulation.
+func (simulator *Simulator) ListDevices(context.Context) ([]*smartthings.Device, error) {
+	simulator.mu.Lock()
+	defer simulator.mu.Unlock()
+	simulator.advance()
+
+	devices := make([]*smartthings.Device, 0, len(simulator.devices))
+	for _, device := range simulator.devices {
+		devices = append(devices, device.device)
+	}
+	return devices, nil
+}
+
+func (simulator *Simulator) ListLocations(context.Context, url.Values) ([]*smartthings.Location, error) {
+	return simulator.locations, nil
+}
+
+func (simulator *Simulator) ListRooms(_ context.Context, locationId string) ([]*smartthings.Room, error) {
+	var rooms []*smartthings.Room
+	for _, room := range simulator.rooms {
+		if room.LocationID == locationId {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, nil
+}
+
+func (simulator *Simulator) GetDeviceComponentStatus(_ context.Context, deviceId, componentId string) (smartthings.ComponentStatus, error) {
+	simulator.mu.Lock()
+	defer simulator.mu.Unlock()
+	if device, ok := simulator.byId[deviceId]; ok && componentId == "main" {
+		return simulator.status(device), nil
+	}
+	return nil, fmt.Errorf("simulated device %s has no component %s", deviceId, componentId)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func TestSimulatorInventory(t *testing.T) {
+	ctx := context.Background()
+	simulator := NewSimulator(SimulatorConfig{Homes: 2, Rooms: 10, Devices: 7, Seed: 1})
+
+	locations, err := simulator.ListLocations(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, locations, 2)
+
+	rooms, err := simulator.ListRooms(ctx, locations[1].ID)
+	require.NoError(t, err)
+	require.Len(t, rooms, 10)
+	assert.Equal(t, "Living Room", rooms[0].Name)
+	assert.Equal(t, "Living Room 2", rooms[8].Name)
+
+	devices, err := simulator.ListDevices(ctx)
+	require.NoError(t, err)
+	assert.Len(t, devices, 2*10*7)
+
+	ids := make(map[string]bool)
+	for _, device := range devices {
+		assert.False(t, ids[device.DeviceID], "duplicate id %s", device.DeviceID)
+		ids[device.DeviceID] = true
+
+		status, err := simulator.GetDeviceComponentStatus(ctx, device.DeviceID, "main")
+		require.NoError(t, err)
+		for _, capability := range device.Components[0].Capabilities {
+			assert.Contains(t, status, capability.ID, device.Label)
+		}
+	}
+
+	_, err = simulator.GetDeviceComponentStatus(ctx, devices[0].DeviceID, "other")
+	assert.Error(t, err)
+}
+
+func TestSimulatorDrift(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	simulator := newSimulator(SimulatorConfig{Homes: 1, Rooms: 1, Devices: 5, Seed: 1}, clock.Now)
+
+	devices, err := simulator.ListDevices(ctx)
+	require.NoError(t, err)
+	value := func(kind, capability, attribute string) interface{} {
+		for _, device := range devices {
+			if device.Name == "simulated-"+kind {
+				status, err := simulator.GetDeviceComponentStatus(ctx, device.DeviceID, "main")
+				require.NoError(t, err)
+				return status[capability][attribute]["value"]
+			}
+		}
+		t.Fatalf("no %s device", kind)
+		return nil
+	}
+
+	temperatures := make(map[float64]bool)
+	contacts := make(map[interface{}]bool)
+	energy := value("plug", "energyMeter", "energy").(float64)
+	for i := 0; i < 24*60; i++ {
+		clock.now = clock.now.Add(time.Minute)
+		_, err := simulator.ListDevices(ctx)
+		require.NoError(t, err)
+
+		temperature := value("temperature", "temperatureMeasurement", "temperature").(float64)
+		assert.InDelta(t, 20, temperature, 8)
+		temperatures[temperature] = true
+		contacts[value("contact", "contactSensor", "contact")] = true
+
+		next := value("plug", "energyMeter", "energy").(float64)
+		assert.GreaterOrEqual(t, next, energy)
+		energy = next
+	}
+
+	assert.Greater(t, len(temperatures), 5, "temperature should wander")
+	assert.Len(t, contacts, 2, "the door should open and close")
+}
+
+func TestSimulatorSeed(t *testing.T) {
+	ctx := context.Background()
+	statuses := func() []smartthings.ComponentStatus {
+		clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		simulator := newSimulator(SimulatorConfig{Homes: 1, Rooms: 2, Devices: 5, Seed: 42}, clock.Now)
+		clock.now = clock.now.Add(time.Hour)
+
+		devices, err := simulator.ListDevices(ctx)
+		require.NoError(t, err)
+		var statuses []smartthings.ComponentStatus
+		for _, device := range devices {
+			status, err := simulator.GetDeviceComponentStatus(ctx, device.DeviceID, "main")
+			require.NoError(t, err)
+			statuses = append(statuses, status)
+		}
+		return statuses
+	}
+	assert.Equal(t, statuses(), statuses())
+}
+
+func TestCollectorSimulator(t *testing.T) {
+	simulator := NewSimulator(SimulatorConfig{Homes: 1, Rooms: 2, Devices: 5, Seed: 1})
+	collector := NewCollector(NewPoller("simulated", simulator, "", DeviceFilter{}, 0))
+
+	assert.Equal(t, 10, testutil.CollectAndCount(collector, "smartthings_device"))
+	assert.Equal(t, 2, testutil.CollectAndCount(collector, "smartthings_attribute_energy"))
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "smartthings_up"))
+}
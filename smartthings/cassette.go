@@ -0,0 +1,221 @@
+package smartthings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// scrubbedHeaders are never written to a cassette.
+var scrubbedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// Cassette is a recorded api session, saved as json.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is a single request and its response, the url only has the
+// path and query so it can be replayed against any base url.
+type Interaction struct {
+	Request  *RecordedRequest  `json:"request"`
+	Response *RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body"`
+}
+
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cassette, nil
+}
+
+func (cassette *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Recorder is an http.RoundTripper recording every request made through
+// Transport. Authorization headers are never recorded and every key of
+// Replacements, like a device id, is replaced by its value in the urls and
+// bodies, so a cassette can be shared.
+type Recorder struct {
+	Transport    http.RoundTripper
+	Replacements map[string]string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder records the requests made with transport, which defaults to
+// http.DefaultTransport.
+func NewRecorder(transport http.RoundTripper, replacements map[string]string) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{Transport: transport, Replacements: replacements}
+}
+
+func (recorder *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := recorder.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	interaction := &Interaction{
+		Request: &RecordedRequest{
+			Method:  req.Method,
+			URL:     recorder.scrub(req.URL.RequestURI()),
+			Headers: scrubHeaders(req.Header),
+			Body:    recorder.scrub(string(reqBody)),
+		},
+		Response: &RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Headers:    scrubHeaders(resp.Header),
+			Body:       recorder.scrub(string(respBody)),
+		},
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.cassette.Interactions = append(recorder.cassette.Interactions, interaction)
+
+	return resp, nil
+}
+
+// Cassette returns a copy of the interactions recorded so far.
+func (recorder *Recorder) Cassette() *Cassette {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return &Cassette{Interactions: append([]*Interaction(nil), recorder.cassette.Interactions...)}
+}
+
+func (recorder *Recorder) Save(path string) error {
+	return recorder.Cassette().Save(path)
+}
+
+// scrub applies the replacements, longest first so a replacement never
+// breaks a longer one it is a part of.
+func (recorder *Recorder) scrub(s string) string {
+	keys := make([]string, 0, len(recorder.Replacements))
+	for key := range recorder.Replacements {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+
+	for _, key := range keys {
+		s = strings.ReplaceAll(s, key, recorder.Replacements[key])
+	}
+	return s
+}
+
+func scrubHeaders(header http.Header) http.Header {
+	scrubbed := header.Clone()
+	for _, name := range scrubbedHeaders {
+		scrubbed.Del(name)
+	}
+	if len(scrubbed) == 0 {
+		return nil
+	}
+	return scrubbed
+}
+
+// Replayer is an http.RoundTripper answering requests from a cassette
+// without a network. Requests are matched by method, path and query in the
+// order they were recorded, once every match was used the last one is
+// repeated, so a session can be replayed any number of times.
+type Replayer struct {
+	cassette *Cassette
+
+	mu   sync.Mutex
+	used map[*Interaction]bool
+}
+
+func NewReplayer(cassette *Cassette) *Replayer {
+	return &Replayer{cassette: cassette, used: make(map[*Interaction]bool)}
+}
+
+func (replayer *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+
+	var match *Interaction
+	for _, interaction := range replayer.cassette.Interactions {
+		if interaction.Request.Method != req.Method || interaction.Request.URL != req.URL.RequestURI() {
+			continue
+		}
+		match = interaction
+		if !replayer.used[interaction] {
+			break
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no recorded interaction for %s %s", req.Method, req.URL.RequestURI())
+	}
+	replayer.used[match] = true
+
+	header := match.Response.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", match.Response.StatusCode, http.StatusText(match.Response.StatusCode)),
+		StatusCode:    match.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(match.Response.Body)),
+		ContentLength: int64(len(match.Response.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package smartthings_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/setheck/smartthings-exporter/smartthings/smartthingstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	server := smartthingstest.NewServer(&smartthingstest.Fixture{
+		Devices: []*smartthings.Device{{DeviceID: "4d5f2a1c-real-id", Label: "Porch Light"}},
+		Status: map[string]map[string]smartthings.ComponentStatus{
+			"4d5f2a1c-real-id": {"main": {"switch": {"switch": {"value": "on"}}}},
+		},
+	})
+	defer server.Close()
+
+	recorder := smartthings.NewRecorder(server.Server.Client().Transport, map[string]string{"4d5f2a1c-real-id": "device-1"})
+	client := smartthings.NewClient(smartthingstest.Token, &http.Client{Transport: recorder})
+	client.SetBaseURL(server.APIURL())
+
+	ctx := context.Background()
+	_, err := client.ListDevices(ctx)
+	require.NoError(t, err)
+	_, err = client.GetDeviceComponentStatus(ctx, "4d5f2a1c-real-id", "main")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	require.NoError(t, recorder.Save(path))
+	cassette, err := smartthings.LoadCassette(path)
+	require.NoError(t, err)
+	require.Len(t, cassette.Interactions, 2)
+	for _, interaction := range cassette.Interactions {
+		for _, recorded := range []string{interaction.Request.URL, interaction.Response.Body} {
+			assert.NotContains(t, recorded, "4d5f2a1c-real-id")
+			assert.NotContains(t, recorded, smartthingstest.Token)
+		}
+		assert.Empty(t, interaction.Request.Headers.Get("Authorization"))
+	}
+
+	replay := smartthings.NewClient("any-token", &http.Client{Transport: smartthings.NewReplayer(cassette)})
+	replay.SetBaseURL("http://replay.invalid/v1")
+	for i := 0; i < 2; i++ {
+		devices, err := replay.ListDevices(ctx)
+		require.NoError(t, err)
+		require.Len(t, devices, 1)
+		assert.Equal(t, "device-1", devices[0].DeviceID)
+
+		status, err := replay.GetDeviceComponentStatus(ctx, "device-1", "main")
+		require.NoError(t, err)
+		assert.Equal(t, "on", status["switch"]["switch"]["value"])
+	}
+
+	_, err = replay.ListLocations(ctx, nil)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "no recorded interaction for GET /v1/locations")
+}
@@ -1,19 +1,21 @@
 package smartthings
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
-var (
-	Version = "dev"
-	debug   = false
-)
+var Version = "dev"
 
 const API = "https://api.smartthings.com/v1"
 
@@ -132,11 +134,40 @@ type InstalledApp struct {
 	LastUpdatedDate    string            `json:"lastUpdatedDate"`
 }
 
+const (
+	SubscriptionSourceDevice     = "DEVICE"
+	SubscriptionSourceCapability = "CAPABILITY"
+)
+
 type Subscription struct {
-	ID             string  `json:"id,omitempty"`
-	InstalledAppId string  `json:"installedAppId,omitempty"`
-	SourceType     string  `json:"sourceType,omitempty"`
-	Device         *Device `json:"device,omitempty"`
+	ID             string                  `json:"id,omitempty"`
+	InstalledAppId string                  `json:"installedAppId,omitempty"`
+	SourceType     string                  `json:"sourceType,omitempty"`
+	Device         *DeviceSubscription     `json:"device,omitempty"`
+	Capability     *CapabilitySubscription `json:"capability,omitempty"`
+}
+
+// CapabilitySubscription subscribes to the events of a capability of every
+// device in a location, "*" matches every attribute or value.
+type CapabilitySubscription struct {
+	LocationID       string `json:"locationId"`
+	Capability       string `json:"capability"`
+	Attribute        string `json:"attribute,omitempty"`
+	Value            string `json:"value,omitempty"`
+	StateChangeOnly  bool   `json:"stateChangeOnly"`
+	SubscriptionName string `json:"subscriptionName,omitempty"`
+}
+
+// DeviceSubscription subscribes to the events of a device, "*" matches
+// every component, capability, attribute or value.
+type DeviceSubscription struct {
+	DeviceID         string `json:"deviceId"`
+	ComponentID      string `json:"componentId,omitempty"`
+	Capability       string `json:"capability,omitempty"`
+	Attribute        string `json:"attribute,omitempty"`
+	Value            string `json:"value,omitempty"`
+	StateChangeOnly  bool   `json:"stateChangeOnly"`
+	SubscriptionName string `json:"subscriptionName,omitempty"`
 }
 
 type Cron struct {
@@ -162,18 +193,66 @@ type Schedule struct {
 }
 
 type Client struct {
-	token      string
+	tokens     tokenSourceHolder
 	httpClient *http.Client
+	logger     *slog.Logger
+	baseURL    string
 }
 
 func NewClient(token string, httpClient *http.Client) *Client {
+	return NewTokenSourceClient(StaticToken(strings.TrimSpace(token)), httpClient)
+}
+
+// NewTokenSourceClient gets the token of every request from tokens.
+func NewTokenSourceClient(tokens TokenSource, httpClient *http.Client) *Client {
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
-	return &Client{
-		token:      strings.TrimSpace(token),
-		httpClient: httpClient,
+	client := &Client{httpClient: httpClient}
+	client.tokens.set(tokens)
+	return client
+}
+
+// NewOAuthClient authenticates with the access tokens of an oauth2 app,
+// which are refreshed before they expire and when the api rejects them.
+func NewOAuthClient(tokens *OAuthTokens, httpClient *http.Client) *Client {
+	return NewTokenSourceClient(tokens, httpClient)
+}
+
+// SetLogger logs the requests of the client to logger, slog.Default() is
+// used otherwise. Raw responses are logged at debug level, tokens never are.
+func (client *Client) SetLogger(logger *slog.Logger) {
+	client.logger = logger
+}
+
+// SetBaseURL sends the requests to baseURL instead of API, like a
+// smartthingstest server.
+func (client *Client) SetBaseURL(baseURL string) {
+	client.baseURL = strings.TrimSuffix(baseURL, "/")
+}
+
+func (client *Client) api() string {
+	if client.baseURL != "" {
+		return client.baseURL
+	}
+	return API
+}
+
+func (client *Client) log() *slog.Logger {
+	if client.logger != nil {
+		return client.logger
 	}
+	return slog.Default()
+}
+
+func (client *Client) TokenSource() TokenSource {
+	return client.tokens.get()
+}
+
+// SetTokenSource replaces the token source, requests in flight finish
+// with the token they started with.
+func (client *Client) SetTokenSource(tokens TokenSource) {
+	client.tokens.set(tokens)
 }
 
 func (client *Client) ListInstalledApps(ctx context.Context, params url.Values) ([]*InstalledApp, error) {
@@ -219,31 +298,11 @@ func (client *Client) ListAllDeviceProfiles(ctx context.Context, params url.Valu
 }
 
 func (client *Client) ListRooms(ctx context.Context, locationId string) ([]*Room, error) {
-	resp, err := client.apiGet(ctx, fmt.Sprintf("/locations/%s/rooms", locationId), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	var rooms []*Room
-	if _, err := parseListResponse(resp.Body, &rooms); err != nil {
-		return nil, err
-	}
-
-	return rooms, err
+	return listAll[*Room](ctx, client, fmt.Sprintf("/locations/%s/rooms", locationId), nil)
 }
 
 func (client *Client) ListLocations(ctx context.Context, params url.Values) ([]*Location, error) {
-	resp, err := client.apiGet(ctx, "/locations", params)
-	if err != nil {
-		return nil, err
-	}
-
-	var locations []*Location
-	if _, err := parseListResponse(resp.Body, &locations); err != nil {
-		return nil, err
-	}
-
-	return locations, err
+	return listAll[*Location](ctx, client, "/locations", params)
 }
 
 func (client *Client) ListAllCapabilities(ctx context.Context, params url.Values) ([]*Capability, error) {
@@ -275,17 +334,7 @@ func (client *Client) GetCapabilitiesByIDAndVersion(ctx context.Context, capabil
 }
 
 func (client *Client) ListDevices(ctx context.Context) ([]*Device, error) {
-	resp, err := client.apiGet(ctx, "/devices", nil)
-	if err != nil {
-		return nil, err
-	}
-
-	var devices []*Device
-	if _, err = parseListResponse(resp.Body, &devices); err != nil {
-		return nil, err
-	}
-
-	return devices, err
+	return listAll[*Device](ctx, client, "/devices", nil)
 }
 
 func (client *Client) GetFullDeviceStatus(ctx context.Context, deviceId string) ([]*Component, error) {
@@ -340,6 +389,27 @@ func (client *Client) ListSubscriptions(ctx context.Context, installedAppId stri
 	return subscriptions, err
 }
 
+func (client *Client) CreateSubscription(ctx context.Context, installedAppId string, subscription *Subscription) (*Subscription, error) {
+	resp, err := client.apiRequest(ctx, http.MethodPost, fmt.Sprintf("/installedapps/%s/subscriptions", installedAppId), nil, subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	var created *Subscription
+	err = parseResponse(resp.Body, &created)
+
+	return created, err
+}
+
+func (client *Client) DeleteAllSubscriptions(ctx context.Context, installedAppId string) error {
+	resp, err := client.apiRequest(ctx, http.MethodDelete, fmt.Sprintf("/installedapps/%s/subscriptions", installedAppId), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
 func (client *Client) ListSchedules(ctx context.Context, installedAppId string) ([]*Schedule, error) {
 	resp, err := client.apiGet(ctx, fmt.Sprintf("/installedapps/%s/schedules", installedAppId), nil)
 	if err != nil {
@@ -368,41 +438,161 @@ func (client *Client) ListRules(ctx context.Context, params url.Values) ([]*Rule
 	return rules, err
 }
 
+// listAll gets every page of a list endpoint by following the next links.
+func listAll[T any](ctx context.Context, client *Client, endpoint string, queryParams url.Values) ([]T, error) {
+	var items []T
+	for {
+		resp, err := client.apiGet(ctx, endpoint, queryParams)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []T
+		listResponse, err := parseListResponse(resp.Body, &page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+
+		next := listResponse.PagingLinks.Next["href"]
+		if next == "" {
+			return items, nil
+		}
+		if endpoint, queryParams, err = client.pageEndpoint(next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pageEndpoint turns the href of a paging link into an endpoint of the
+// client, the request goes to the base url of the client whatever the
+// host of the link is, so the token is never sent elsewhere.
+func (client *Client) pageEndpoint(href string) (string, url.Values, error) {
+	link, err := url.Parse(href)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid paging link %q: %w", href, err)
+	}
+	base, err := url.Parse(client.api())
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimPrefix(link.Path, base.Path), link.Query(), nil
+}
+
 func (client *Client) apiGet(ctx context.Context, endpoint string, queryParams url.Values) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, API+endpoint, nil)
+	return client.apiRequest(ctx, http.MethodGet, endpoint, queryParams, nil)
+}
+
+func (client *Client) apiRequest(ctx context.Context, method, endpoint string, queryParams url.Values, body interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	logger := client.log().With("request_id", newRequestID(), "method", method, "endpoint", endpoint)
+
+	tokens := client.tokens.get()
+	if tokens == nil {
+		return nil, errNoTokenSource
+	}
+	token, err := tokens.Token(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	queryParams.Encode()
-	req.URL.RawQuery = queryParams.Encode()
-	req.Header.Add("User-Agent", fmt.Sprintf("go-smartthings-%s", Version))
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", client.token))
-
-	resp, err := client.httpClient.Do(req)
+	start := time.Now()
+	resp, err := client.do(ctx, method, endpoint, queryParams, data, token)
 	if err != nil {
+		logger.DebugContext(ctx, "api request failed", "error", err)
 		return nil, err
 	}
 
-	if resp.StatusCode >= 400 {
-		if err := checkErrorResponse(resp.Body); err != nil {
+	if refreshable, ok := tokens.(RefreshableTokenSource); ok && resp.StatusCode == http.StatusUnauthorized {
+		// the token may have been revoked or expired early, refresh and retry once
+		logger.DebugContext(ctx, "api rejected the token, refreshing")
+		_ = resp.Body.Close()
+		if err := refreshable.Refresh(ctx, token); err != nil {
 			return nil, err
 		}
+		if token, err = refreshable.Token(ctx); err != nil {
+			return nil, err
+		}
+		if resp, err = client.do(ctx, method, endpoint, queryParams, data, token); err != nil {
+			logger.DebugContext(ctx, "api request failed", "error", err)
+			return nil, err
+		}
+	}
+	logger = logger.With("status", resp.StatusCode, "duration", time.Since(start))
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		requestId, err := checkErrorResponse(resp.Body)
+		if err == nil {
+			err = fmt.Errorf("failed request: %s - %s", resp.Request.URL.String(), resp.Status)
+		}
+		logger.DebugContext(ctx, "api request failed", "api_request_id", requestId, "error", err)
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		case http.StatusTooManyRequests:
+			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+				return nil, fmt.Errorf("%w, retry after %s: %v", ErrRateLimited, retryAfter, err)
+			}
+			return nil, fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
 
-		return nil, fmt.Errorf("failed request: %s - %s", req.URL.String(), resp.Status)
+		return nil, err
+	}
+
+	if logger.Enabled(ctx, slog.LevelDebug) {
+		raw, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		logger.DebugContext(ctx, "api response", "body", string(raw))
 	}
 
 	return resp, nil
 }
 
-func parseListResponse(input io.ReadCloser, itemsOut interface{}) (*ListResponse, error) {
-	raw, err := io.ReadAll(input)
+// newRequestID identifies the log lines of a single request.
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (client *Client) do(ctx context.Context, method, endpoint string, queryParams url.Values, body []byte, token string) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, client.api()+endpoint, reqBody)
 	if err != nil {
 		return nil, err
 	}
 
-	if debug {
-		fmt.Println("raw response:", string(raw))
+	req.URL.RawQuery = queryParams.Encode()
+	req.Header.Add("User-Agent", fmt.Sprintf("go-smartthings-%s", Version))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	return client.httpClient.Do(req)
+}
+
+func parseListResponse(input io.ReadCloser, itemsOut interface{}) (*ListResponse, error) {
+	raw, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
 	}
 
 	var listResponse *ListResponse
@@ -420,10 +610,6 @@ func parseResponse(input io.ReadCloser, out interface{}) error {
 		return err
 	}
 
-	if debug {
-		fmt.Println("raw response:", string(raw))
-	}
-
 	if err := json.Unmarshal(raw, &out); err != nil {
 		return err
 	}
@@ -1,10 +1,20 @@
 package smartthings
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewClient(t *testing.T) {
@@ -22,7 +32,9 @@ func TestNewClient(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 
 			client := NewClient(test.token, test.httpClient)
-			assert.Equal(t, testToken, client.token)
+			token, err := client.TokenSource().Token(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, testToken, token)
 			if test.httpClient == nil {
 				assert.Equal(t, client.httpClient, http.DefaultClient)
 			} else {
@@ -31,3 +43,89 @@ func TestNewClient(t *testing.T) {
 		})
 	}
 }
+
+func TestFileTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	_, err := NewFileTokenSource(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("first-token\n"), 0600))
+	source, err := NewFileTokenSource(path)
+	require.NoError(t, err)
+
+	client := NewTokenSourceClient(source, nil)
+	token, _ := client.TokenSource().Token(context.Background())
+	assert.Equal(t, "first-token", token)
+
+	require.NoError(t, os.WriteFile(path, []byte(""), 0600))
+	changed, err := source.Reload()
+	assert.Error(t, err)
+	assert.False(t, changed)
+	token, _ = source.Token(context.Background())
+	assert.Equal(t, "first-token", token, "an empty file keeps the current token")
+
+	require.NoError(t, os.WriteFile(path, []byte("second-token"), 0600))
+	changed, err = source.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	token, _ = client.TokenSource().Token(context.Background())
+	assert.Equal(t, "second-token", token)
+
+	client.SetTokenSource(StaticToken("swapped-token"))
+	token, _ = client.TokenSource().Token(context.Background())
+	assert.Equal(t, "swapped-token", token)
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	client := NewClient("bad-token", &http.Client{Transport: &rewriteTransport{target: target}})
+	_, err := client.ListDevices(context.Background())
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestClientLogging(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/devices/dev-1/components/main/status" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"requestId":"api-request-1","error":{"code":"NotFoundError","message":"not found"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"items":[{"deviceId":"dev-1"}]}`))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	var logs bytes.Buffer
+	client := NewClient("secret-token", &http.Client{Transport: &rewriteTransport{target: target}})
+	client.SetLogger(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	devices, err := client.ListDevices(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 1, "the body is still readable after logging it")
+	_, err = client.GetDeviceComponentStatus(context.Background(), "dev-1", "main")
+	require.Error(t, err)
+
+	assert.NotContains(t, logs.String(), "secret-token")
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		lines = append(lines, entry)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, "api response", lines[0]["msg"])
+	assert.Equal(t, "/devices", lines[0]["endpoint"])
+	assert.NotEmpty(t, lines[0]["request_id"])
+	assert.Contains(t, lines[0]["body"], "dev-1")
+	assert.Equal(t, "api request failed", lines[1]["msg"])
+	assert.Equal(t, "/devices/dev-1/components/main/status", lines[1]["endpoint"])
+	assert.Equal(t, "api-request-1", lines[1]["api_request_id"])
+	assert.Equal(t, float64(http.StatusNotFound), lines[1]["status"])
+	assert.NotEqual(t, lines[0]["request_id"], lines[1]["request_id"])
+}
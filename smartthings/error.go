@@ -2,10 +2,18 @@ package smartthings
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 )
 
+var (
+	// ErrUnauthorized is returned when the api rejects the token.
+	ErrUnauthorized = errors.New("unauthorized, the token is invalid or expired")
+	// ErrRateLimited is returned when the api throttles the requests.
+	ErrRateLimited = errors.New("rate limited by the api")
+)
+
 type ErrorResponse struct {
 	RequestID string `json:"requestId"`
 	Error     *Error `json:"error"`
@@ -22,18 +30,21 @@ func (e *Error) Error() string {
 	return fmt.Sprint(e.Code, e.Message, e.Target)
 }
 
-func checkErrorResponse(r io.ReadCloser) error {
+// checkErrorResponse returns the request id and error of an error
+// response, the error is nil when the body isn't one.
+func checkErrorResponse(r io.ReadCloser) (string, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	var errResponse *ErrorResponse
-	if err := json.Unmarshal(data, &errResponse); err == nil {
+	if err := json.Unmarshal(data, &errResponse); err == nil && errResponse != nil {
 		if errResponse.Error != nil {
-			return errResponse.Error
+			return errResponse.RequestID, errResponse.Error
 		}
+		return errResponse.RequestID, nil
 	}
 
-	return nil
+	return "", nil
 }
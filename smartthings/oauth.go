@@ -0,0 +1,294 @@
+package smartthings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuthorizeURL = "https://api.smartthings.com/oauth/authorize"
+	TokenURL     = "https://auth-global.api.smartthings.com/oauth/token"
+
+	// tokens are refreshed this long before they expire
+	refreshBefore = 5 * time.Minute
+)
+
+var ErrNotAuthorized = errors.New("oauth2 authorization is required")
+
+// Token is an oauth2 token as returned by the token endpoint, with the
+// expiry calculated when it was received.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	TokenType    string    `json:"token_type,omitempty"`
+	ExpiresIn    int       `json:"expires_in,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+	Scope        string    `json:"scope,omitempty"`
+}
+
+// Expired reports whether the token expires within d.
+func (token *Token) Expired(d time.Duration) bool {
+	return !token.Expiry.IsZero() && time.Now().Add(d).After(token.Expiry)
+}
+
+// OAuthConfig describes a smartthings oauth2 app using the authorization
+// code flow.
+type OAuthConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// AuthorizeURL and TokenURL default to the smartthings endpoints.
+	AuthorizeURL string
+	TokenURL     string
+	HTTPClient   *http.Client
+}
+
+// AuthCodeURL is the url the user authorizes the app at, smartthings
+// redirects back to RedirectURL with the code and state.
+func (config *OAuthConfig) AuthCodeURL(state string) string {
+	authorizeURL := config.AuthorizeURL
+	if authorizeURL == "" {
+		authorizeURL = AuthorizeURL
+	}
+
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {config.ClientID},
+		"redirect_uri":  {config.RedirectURL},
+		"scope":         {strings.Join(config.Scopes, " ")},
+		"state":         {state},
+	}
+	return authorizeURL + "?" + params.Encode()
+}
+
+// Exchange trades an authorization code for a token.
+func (config *OAuthConfig) Exchange(ctx context.Context, code string) (*Token, error) {
+	return config.tokenRequest(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {config.RedirectURL},
+		"client_id":    {config.ClientID},
+	})
+}
+
+// Refresh trades a refresh token for a new token, smartthings rotates the
+// refresh token as well.
+func (config *OAuthConfig) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	return config.tokenRequest(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {config.ClientID},
+	})
+}
+
+func (config *OAuthConfig) tokenRequest(ctx context.Context, form url.Values) (*Token, error) {
+	tokenURL := config.TokenURL
+	if tokenURL == "" {
+		tokenURL = TokenURL
+	}
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("User-Agent", fmt.Sprintf("go-smartthings-%s", Version))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		var oauthErr struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal(data, &oauthErr) == nil && oauthErr.Error != "" {
+			return nil, fmt.Errorf("token request failed: %s %s", oauthErr.Error, oauthErr.ErrorDescription)
+		}
+		return nil, fmt.Errorf("failed request: %s - %s", tokenURL, resp.Status)
+	}
+
+	var token Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("token response without access_token")
+	}
+	if token.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return &token, nil
+}
+
+// TokenStore persists the token of an OAuthTokens between restarts.
+type TokenStore interface {
+	// Load returns nil without error when no token was saved yet.
+	Load() (*Token, error)
+	Save(token *Token) error
+}
+
+// FileTokenStore keeps the token as json in a file only readable by the owner.
+type FileTokenStore struct {
+	Path string
+}
+
+func (store *FileTokenStore) Load() (*Token, error) {
+	data, err := os.ReadFile(store.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var token Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("%s: %w", store.Path, err)
+	}
+	return &token, nil
+}
+
+// Save replaces the file atomically, so a crash never loses the only copy
+// of a rotated refresh token.
+func (store *FileTokenStore) Save(token *Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(store.Path), filepath.Base(store.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), store.Path)
+}
+
+// OAuthTokens provides access tokens of an oauth2 app, refreshing them
+// shortly before they expire and saving every new token to the store.
+type OAuthTokens struct {
+	config *OAuthConfig
+	store  TokenStore
+
+	mu    sync.Mutex
+	token *Token
+}
+
+// NewOAuthTokens loads the saved token from store, if any.
+func NewOAuthTokens(config *OAuthConfig, store TokenStore) (*OAuthTokens, error) {
+	token, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &OAuthTokens{config: config, store: store, token: token}, nil
+}
+
+func (tokens *OAuthTokens) Config() *OAuthConfig {
+	return tokens.config
+}
+
+// Authorized reports whether there is a token, authorization is required first otherwise.
+func (tokens *OAuthTokens) Authorized() bool {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	return tokens.token != nil
+}
+
+// Exchange completes the authorization with the code smartthings redirected back with.
+func (tokens *OAuthTokens) Exchange(ctx context.Context, code string) error {
+	token, err := tokens.config.Exchange(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	return tokens.set(token)
+}
+
+// Token returns a valid access token, refreshing it when it is about to
+// expire.
+func (tokens *OAuthTokens) Token(ctx context.Context) (string, error) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	if tokens.token == nil {
+		return "", ErrNotAuthorized
+	}
+	if tokens.token.Expired(refreshBefore) {
+		if err := tokens.refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+	return tokens.token.AccessToken, nil
+}
+
+// Refresh forces a refresh unless the access token already changed from
+// rejected, which happens when concurrent requests are rejected at once.
+func (tokens *OAuthTokens) Refresh(ctx context.Context, rejected string) error {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	if tokens.token == nil {
+		return ErrNotAuthorized
+	}
+	if tokens.token.AccessToken != rejected {
+		return nil
+	}
+	return tokens.refresh(ctx)
+}
+
+func (tokens *OAuthTokens) refresh(ctx context.Context) error {
+	if tokens.token.RefreshToken == "" {
+		return fmt.Errorf("%w: no refresh token", ErrNotAuthorized)
+	}
+
+	token, err := tokens.config.Refresh(ctx, tokens.token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = tokens.token.RefreshToken
+	}
+	return tokens.set(token)
+}
+
+func (tokens *OAuthTokens) set(token *Token) error {
+	tokens.token = token
+	return tokens.store.Save(token)
+}
@@ -0,0 +1,148 @@
+package smartthings
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteTransport sends every request to the test server.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (transport *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = transport.target.Scheme
+	req.URL.Host = transport.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+type fakeOAuthServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	refreshes int
+	valid     string
+}
+
+func newFakeOAuthServer(t *testing.T) *fakeOAuthServer {
+	server := &fakeOAuthServer{valid: "access-0"}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/oauth/token":
+			clientID, clientSecret, _ := r.BasicAuth()
+			assert.Equal(t, "client-id", clientID)
+			assert.Equal(t, "client-secret", clientSecret)
+			require.NoError(t, r.ParseForm())
+
+			switch r.PostForm.Get("grant_type") {
+			case "authorization_code":
+				assert.Equal(t, "the-code", r.PostForm.Get("code"))
+			case "refresh_token":
+				assert.Equal(t, fmt.Sprint("refresh-", server.refreshes), r.PostForm.Get("refresh_token"))
+				server.refreshes++
+			}
+			server.valid = fmt.Sprint("access-", server.refreshes)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  server.valid,
+				"refresh_token": fmt.Sprint("refresh-", server.refreshes),
+				"token_type":    "bearer",
+				"expires_in":    86399,
+			})
+		default:
+			if r.Header.Get("Authorization") != "Bearer "+server.valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"items":[{"deviceId":"dev-1"}]}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *fakeOAuthServer) config() *OAuthConfig {
+	return &OAuthConfig{
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://localhost/oauth/callback",
+		Scopes:       []string{"r:devices:*"},
+		TokenURL:     server.URL + "/oauth/token",
+	}
+}
+
+func (server *fakeOAuthServer) client(tokens *OAuthTokens) *Client {
+	target, _ := url.Parse(server.URL)
+	return NewOAuthClient(tokens, &http.Client{Transport: &rewriteTransport{target: target}})
+}
+
+func TestOAuthClientRefresh(t *testing.T) {
+	server := newFakeOAuthServer(t)
+	store := &FileTokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+
+	tokens, err := NewOAuthTokens(server.config(), store)
+	require.NoError(t, err)
+	assert.False(t, tokens.Authorized())
+
+	client := server.client(tokens)
+	_, err = client.ListDevices(context.Background())
+	assert.ErrorIs(t, err, ErrNotAuthorized)
+
+	require.NoError(t, tokens.Exchange(context.Background(), "the-code"))
+	devices, err := client.ListDevices(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, 0, server.refreshes)
+
+	// about to expire, refreshed before the request
+	tokens.token.Expiry = time.Now().Add(time.Minute)
+	_, err = client.ListDevices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.refreshes)
+
+	// revoked early, refreshed after the api rejects it
+	server.mu.Lock()
+	server.valid = "revoked"
+	server.mu.Unlock()
+	_, err = client.ListDevices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, server.refreshes)
+
+	// the rotated refresh token survives a restart
+	saved, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-2", saved.RefreshToken)
+	restored, err := NewOAuthTokens(server.config(), store)
+	require.NoError(t, err)
+	_, err = server.client(restored).ListDevices(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestOAuthConfigAuthCodeURL(t *testing.T) {
+	config := &OAuthConfig{ClientID: "id", RedirectURL: "http://localhost/cb", Scopes: []string{"r:devices:*", "r:locations:*"}}
+
+	authURL, err := url.Parse(config.AuthCodeURL("state-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "api.smartthings.com", authURL.Host)
+	assert.Equal(t, url.Values{
+		"response_type": {"code"},
+		"client_id":     {"id"},
+		"redirect_uri":  {"http://localhost/cb"},
+		"scope":         {"r:devices:* r:locations:*"},
+		"state":         {"state-1"},
+	}, authURL.Query())
+}
@@ -0,0 +1,411 @@
+package smartthings
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+const (
+	KeyServer = "https://key.smartthings.com"
+
+	signatureAlgorithm = "rsa-sha256"
+	defaultKeyTTL      = 24 * time.Hour
+	keyFetchTimeout    = 10 * time.Second
+	maxCachedKeys      = 100
+	defaultClockSkew   = 5 * time.Minute
+	maxSignedBodySize  = 1 << 20
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// requiredHeaders must be part of every signature, so the method, path,
+// body and age of a request can't be changed.
+var requiredHeaders = []string{"(request-target)", "digest", "date"}
+
+type cachedKey struct {
+	key     *rsa.PublicKey
+	expires time.Time
+}
+
+// SignatureVerifier verifies the http signature smartthings adds to the
+// requests it sends to webhook smartapps. Public keys are fetched from the
+// smartthings key server by key id and cached. The key id comes from
+// unauthenticated requests, so failed lookups aren't cached, the cache is
+// bounded and unknown keys are fetched at a limited rate.
+type SignatureVerifier struct {
+	keyServer  string
+	httpClient *http.Client
+	keyTTL     time.Duration
+	clockSkew  time.Duration
+	fetch      bool
+	now        func() time.Time
+
+	fetches      singleflight.Group
+	fetchLimiter *rate.Limiter
+	mu           sync.Mutex
+	keys         map[string]cachedKey
+}
+
+func NewSignatureVerifier(httpClient *http.Client) *SignatureVerifier {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &SignatureVerifier{
+		keyServer:  KeyServer,
+		httpClient: httpClient,
+		keyTTL:     defaultKeyTTL,
+		clockSkew:  defaultClockSkew,
+		fetch:      true,
+		now:        time.Now,
+		// smartthings rotates its keys rarely, a burst of unknown keys is
+		// made up
+		fetchLimiter: rate.NewLimiter(rate.Every(time.Second), 5),
+		keys:         make(map[string]cachedKey),
+	}
+}
+
+// NewTestSignatureVerifier only trusts the given keys and never contacts
+// the key server, so it can be used offline with generated keys and
+// SignRequest.
+func NewTestSignatureVerifier(keys map[string]*rsa.PublicKey) *SignatureVerifier {
+	verifier := NewSignatureVerifier(nil)
+	verifier.fetch = false
+	for keyId, key := range keys {
+		verifier.keys[keyId] = cachedKey{key: key}
+	}
+	return verifier
+}
+
+// Middleware rejects requests without a valid signature before they reach next.
+func (verifier *SignatureVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifier.Verify(r); err != nil {
+			slog.Warn("signature verification failed", "path", r.URL.Path, "error", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Verify checks the signature and digest of r. The body is read and
+// replaced, so it can still be read by the caller.
+func (verifier *SignatureVerifier) Verify(r *http.Request) error {
+	params, err := parseSignature(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && algorithm != signatureAlgorithm {
+		return fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidSignature, algorithm)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	for _, header := range requiredHeaders {
+		if !slices.Contains(headers, header) {
+			return fmt.Errorf("%w: %s is not signed", ErrInvalidSignature, header)
+		}
+	}
+	if err := verifier.verifyDigest(r); err != nil {
+		return err
+	}
+	if err := verifier.verifyDate(r.Header.Get("Date")); err != nil {
+		return err
+	}
+
+	key, err := verifier.key(r, params["keyId"])
+	if err != nil {
+		return err
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func (verifier *SignatureVerifier) verifyDigest(r *http.Request) error {
+	digest := r.Header.Get("Digest")
+	if digest == "" {
+		return fmt.Errorf("%w: missing digest", ErrInvalidSignature)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize)); err != nil {
+			return err
+		}
+		_ = r.Body.Close()
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	algorithm, value, _ := strings.Cut(digest, "=")
+	if !strings.EqualFold(algorithm, "SHA-256") {
+		return fmt.Errorf("%w: unsupported digest %s", ErrInvalidSignature, algorithm)
+	}
+	sum := sha256.Sum256(body)
+	if value != base64.StdEncoding.EncodeToString(sum[:]) {
+		return fmt.Errorf("%w: digest mismatch", ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+func (verifier *SignatureVerifier) verifyDate(date string) error {
+	signed, err := http.ParseTime(date)
+	if err != nil {
+		return fmt.Errorf("%w: invalid date %q", ErrInvalidSignature, date)
+	}
+
+	skew := verifier.now().Sub(signed)
+	if skew < -verifier.clockSkew || skew > verifier.clockSkew {
+		return fmt.Errorf("%w: date %s outside of allowed clock skew", ErrInvalidSignature, date)
+	}
+
+	return nil
+}
+
+func (verifier *SignatureVerifier) key(r *http.Request, keyId string) (*rsa.PublicKey, error) {
+	if keyId == "" {
+		return nil, fmt.Errorf("%w: missing keyId", ErrInvalidSignature)
+	}
+
+	if key, ok := verifier.cachedKey(keyId); ok {
+		return key, nil
+	}
+	if !verifier.fetch {
+		return nil, fmt.Errorf("%w: unknown keyId %s", ErrInvalidSignature, keyId)
+	}
+
+	// concurrent requests with the same key id share a single fetch, that
+	// outlives the request it was started for
+	key, err, _ := verifier.fetches.Do(keyId, func() (interface{}, error) {
+		if key, ok := verifier.cachedKey(keyId); ok {
+			return key, nil
+		}
+		if !verifier.fetchLimiter.Allow() {
+			return nil, fmt.Errorf("%w: too many unknown keys, not fetching %s", ErrInvalidSignature, keyId)
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), keyFetchTimeout)
+		defer cancel()
+
+		key, err := verifier.fetchKey(ctx, keyId)
+		if err != nil {
+			return nil, err
+		}
+		verifier.cacheKey(keyId, key)
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key.(*rsa.PublicKey), nil
+}
+
+// cachedKey returns the cached key of keyId, expired keys are removed.
+func (verifier *SignatureVerifier) cachedKey(keyId string) (*rsa.PublicKey, bool) {
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	cached, ok := verifier.keys[keyId]
+	if !ok {
+		return nil, false
+	}
+	if verifier.expired(cached) {
+		delete(verifier.keys, keyId)
+		return nil, false
+	}
+	return cached.key, true
+}
+
+// cacheKey adds a fetched key, removing the expired keys and then the one
+// expiring first when the cache is full.
+func (verifier *SignatureVerifier) cacheKey(keyId string, key *rsa.PublicKey) {
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	if len(verifier.keys) >= maxCachedKeys {
+		oldest := ""
+		for id, cached := range verifier.keys {
+			switch {
+			case verifier.expired(cached):
+				delete(verifier.keys, id)
+			case cached.expires.IsZero():
+				// trusted keys of NewTestSignatureVerifier
+			case oldest == "" || cached.expires.Before(verifier.keys[oldest].expires):
+				oldest = id
+			}
+		}
+		if len(verifier.keys) >= maxCachedKeys && oldest != "" {
+			delete(verifier.keys, oldest)
+		}
+	}
+	verifier.keys[keyId] = cachedKey{key: key, expires: verifier.now().Add(verifier.keyTTL)}
+}
+
+func (verifier *SignatureVerifier) expired(cached cachedKey) bool {
+	return !cached.expires.IsZero() && !verifier.now().Before(cached.expires)
+}
+
+// fetchKey gets the certificate for keyId from the key server.
+func (verifier *SignatureVerifier) fetchKey(ctx context.Context, keyId string) (*rsa.PublicKey, error) {
+	if !strings.HasPrefix(keyId, "/") || strings.Contains(keyId, "..") || strings.ContainsAny(keyId, "?#\\") {
+		return nil, fmt.Errorf("%w: invalid keyId %s", ErrInvalidSignature, keyId)
+	}
+	keyURL, err := url.Parse(verifier.keyServer + keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keyURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", fmt.Sprintf("go-smartthings-%s", Version))
+
+	resp, err := verifier.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed request: %s - %s", keyURL.String(), resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSignedBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePublicKey(data)
+}
+
+func parsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem data found")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "PUBLIC KEY":
+		var err error
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported pem type %s", block.Type)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an rsa key")
+	}
+
+	return rsaKey, nil
+}
+
+// SignRequest signs r the way smartthings signs its webhook requests, for
+// testing handlers behind a SignatureVerifier. It sets the Date and Digest
+// headers, so the body is read and replaced.
+func SignRequest(r *http.Request, keyId string, key *rsa.PrivateKey) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		_ = r.Body.Close()
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	sum := sha256.Sum256(body)
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	if r.Header.Get("Date") == "" {
+		r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	headers := requiredHeaders
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Authorization", fmt.Sprintf(`Signature keyId="%s",signature="%s",headers="%s",algorithm="%s"`,
+		keyId, base64.StdEncoding.EncodeToString(signature), strings.Join(headers, " "), signatureAlgorithm))
+
+	return nil
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+	for _, header := range headers {
+		if header == "(request-target)" {
+			lines = append(lines, fmt.Sprintf("%s: %s %s", header, strings.ToLower(r.Method), r.URL.RequestURI()))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", header, strings.TrimSpace(r.Header.Get(header))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseSignature parses an `Authorization: Signature k1="v1",k2="v2"` header.
+func parseSignature(authorization string) (map[string]string, error) {
+	scheme, value, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Signature") {
+		return nil, ErrMissingSignature
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed parameter %q", ErrInvalidSignature, param)
+		}
+		params[k] = strings.Trim(v, `"`)
+	}
+	if params["signature"] == "" {
+		return nil, fmt.Errorf("%w: missing signature parameter", ErrInvalidSignature)
+	}
+
+	return params, nil
+}
@@ -0,0 +1,173 @@
+package smartthings
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	verifier := NewTestSignatureVerifier(map[string]*rsa.PublicKey{"/test/key": &key.PublicKey})
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	body := `{"lifecycle":"PING","pingData":{"challenge":"abc"}}`
+	tests := []struct {
+		name       string
+		sign       func(r *http.Request)
+		wantStatus int
+	}{
+		{"valid signature", func(r *http.Request) {
+			require.NoError(t, SignRequest(r, "/test/key", key))
+		}, http.StatusNoContent},
+		{"missing signature", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"unknown key", func(r *http.Request) {
+			require.NoError(t, SignRequest(r, "/other/key", key))
+		}, http.StatusUnauthorized},
+		{"wrong key", func(r *http.Request) {
+			require.NoError(t, SignRequest(r, "/test/key", otherKey))
+		}, http.StatusUnauthorized},
+		{"tampered body", func(r *http.Request) {
+			require.NoError(t, SignRequest(r, "/test/key", key))
+			r.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"lifecycle":"UNINSTALL"}`)).Body
+		}, http.StatusUnauthorized},
+		{"tampered path", func(r *http.Request) {
+			require.NoError(t, SignRequest(r, "/test/key", key))
+			r.URL.Path = "/other"
+		}, http.StatusUnauthorized},
+		{"stale date", func(r *http.Request) {
+			r.Header.Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			require.NoError(t, SignRequest(r, "/test/key", key))
+		}, http.StatusUnauthorized},
+		{"only date signed", func(r *http.Request) {
+			require.NoError(t, SignRequest(r, "/test/key", key))
+			signHeaders(t, r, key, "date")
+		}, http.StatusUnauthorized},
+		{"date not signed", func(r *http.Request) {
+			require.NoError(t, SignRequest(r, "/test/key", key))
+			signHeaders(t, r, key, "(request-target)", "digest")
+		}, http.StatusUnauthorized},
+		{"stale unsigned date", func(r *http.Request) {
+			r.Header.Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			require.NoError(t, SignRequest(r, "/test/key", key))
+			signHeaders(t, r, key, "(request-target)", "digest")
+		}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			test.sign(req)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, test.wantStatus, rec.Code)
+		})
+	}
+}
+
+// signHeaders replaces the signature of r with one over only the given headers.
+func signHeaders(t *testing.T, r *http.Request, key *rsa.PrivateKey, headers ...string) {
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	require.NoError(t, err)
+	r.Header.Set("Authorization", fmt.Sprintf(`Signature keyId="/test/key",signature="%s",headers="%s",algorithm="rsa-sha256"`,
+		base64.StdEncoding.EncodeToString(signature), strings.Join(headers, " ")))
+}
+
+func TestSignatureVerifierFetchesKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	var fetches atomic.Int32
+	keyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.URL.Path != "/pl/useast1/key" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}))
+	defer keyServer.Close()
+
+	verifier := NewSignatureVerifier(keyServer.Client())
+	verifier.keyServer = keyServer.URL
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{}`))
+			require.NoError(t, SignRequest(req, "/pl/useast1/key", key))
+			assert.NoError(t, verifier.Verify(req))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), fetches.Load(), "keys are cached")
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{}`))
+	require.NoError(t, SignRequest(req, "/../key", key))
+	assert.ErrorIs(t, verifier.Verify(req), ErrInvalidSignature)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	verify := func(keyId string) error {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{}`))
+		require.NoError(t, SignRequest(req, keyId, key))
+		return verifier.Verify(req)
+	}
+
+	// failed lookups aren't cached, but limited
+	verifier.fetchLimiter = rate.NewLimiter(rate.Every(time.Hour), 2)
+	assert.Error(t, verify("/pl/useast1/missing"))
+	assert.Error(t, verify("/pl/useast1/missing"))
+	assert.Equal(t, int32(3), fetches.Load())
+	assert.ErrorContains(t, verify("/pl/useast1/other"), "too many unknown keys")
+	assert.Equal(t, int32(3), fetches.Load())
+	assert.Len(t, verifier.keys, 1)
+
+	// expired keys are removed
+	verifier.now = func() time.Time { return time.Now().Add(defaultKeyTTL) }
+	_, ok := verifier.cachedKey("/pl/useast1/key")
+	assert.False(t, ok)
+	assert.Empty(t, verifier.keys)
+}
+
+func TestSignatureVerifierKeyCacheLimit(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	verifier := NewSignatureVerifier(nil)
+	for i := 0; i < maxCachedKeys; i++ {
+		verifier.cacheKey(fmt.Sprint("/key/", i), &key.PublicKey)
+	}
+	verifier.keys["/key/0"] = cachedKey{key: &key.PublicKey, expires: time.Now().Add(time.Minute)}
+
+	verifier.cacheKey("/key/new", &key.PublicKey)
+	assert.Len(t, verifier.keys, maxCachedKeys)
+	assert.NotContains(t, verifier.keys, "/key/0", "the key expiring first is removed")
+	assert.Contains(t, verifier.keys, "/key/new")
+}
@@ -0,0 +1,271 @@
+package smartthings
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	LifecyclePing          = "PING"
+	LifecycleConfirmation  = "CONFIRMATION"
+	LifecycleConfiguration = "CONFIGURATION"
+	LifecycleInstall       = "INSTALL"
+	LifecycleUpdate        = "UPDATE"
+	LifecycleEvent         = "EVENT"
+	LifecycleUninstall     = "UNINSTALL"
+
+	EventTypeDevice = "DEVICE_EVENT"
+)
+
+// LifecycleRequest is the body of a request sent by smartthings to a
+// webhook smartapp, only the data matching Lifecycle is set.
+type LifecycleRequest struct {
+	Lifecycle         string             `json:"lifecycle"`
+	ExecutionID       string             `json:"executionId"`
+	AppID             string             `json:"appId"`
+	Locale            string             `json:"locale"`
+	Version           string             `json:"version"`
+	PingData          *PingData          `json:"pingData,omitempty"`
+	ConfirmationData  *ConfirmationData  `json:"confirmationData,omitempty"`
+	ConfigurationData *ConfigurationData `json:"configurationData,omitempty"`
+	InstallData       *InstallData       `json:"installData,omitempty"`
+	UpdateData        *InstallData       `json:"updateData,omitempty"`
+	EventData         *EventData         `json:"eventData,omitempty"`
+	UninstallData     *UninstallData     `json:"uninstallData,omitempty"`
+}
+
+type PingData struct {
+	Challenge string `json:"challenge"`
+}
+
+type ConfirmationData struct {
+	AppID           string `json:"appId"`
+	ConfirmationURL string `json:"confirmationUrl"`
+}
+
+type ConfigurationData struct {
+	InstalledAppID string `json:"installedAppId"`
+	Phase          string `json:"phase"`
+	PageID         string `json:"pageId"`
+	PreviousPageID string `json:"previousPageId"`
+}
+
+type InstalledAppConfig struct {
+	InstalledAppID string                     `json:"installedAppId"`
+	LocationID     string                     `json:"locationId"`
+	Config         map[string]json.RawMessage `json:"config"`
+	Permissions    []string                   `json:"permissions"`
+}
+
+// InstallData is sent on INSTALL and UPDATE, AuthToken is a short lived
+// token scoped to the installed app.
+type InstallData struct {
+	AuthToken    string              `json:"authToken"`
+	RefreshToken string              `json:"refreshToken"`
+	InstalledApp *InstalledAppConfig `json:"installedApp"`
+}
+
+type EventData struct {
+	AuthToken    string              `json:"authToken"`
+	InstalledApp *InstalledAppConfig `json:"installedApp"`
+	Events       []*Event            `json:"events"`
+}
+
+type UninstallData struct {
+	InstalledApp *InstalledAppConfig `json:"installedApp"`
+}
+
+type Event struct {
+	EventTime   string       `json:"eventTime"`
+	EventType   string       `json:"eventType"`
+	DeviceEvent *DeviceEvent `json:"deviceEvent,omitempty"`
+}
+
+type DeviceEvent struct {
+	SubscriptionName string                 `json:"subscriptionName"`
+	EventID          string                 `json:"eventId"`
+	LocationID       string                 `json:"locationId"`
+	DeviceID         string                 `json:"deviceId"`
+	ComponentID      string                 `json:"componentId"`
+	Capability       string                 `json:"capability"`
+	Attribute        string                 `json:"attribute"`
+	Value            interface{}            `json:"value"`
+	ValueType        string                 `json:"valueType"`
+	StateChange      bool                   `json:"stateChange"`
+	Data             map[string]interface{} `json:"data,omitempty"`
+}
+
+// SmartApp handles the lifecycle requests of a webhook smartapp. The
+// callbacks are optional, UPDATE is handled by OnInstall.
+type SmartApp struct {
+	ID          string
+	Name        string
+	Description string
+	Permissions []string
+
+	OnInstall   func(ctx context.Context, data *InstallData) error
+	OnEvent     func(ctx context.Context, data *EventData) error
+	OnUninstall func(ctx context.Context, data *UninstallData) error
+
+	// HTTPClient confirms the app registration, defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func (app *SmartApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request LifecycleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid lifecycle request", http.StatusBadRequest)
+		return
+	}
+
+	response, err := app.handle(r.Context(), &request)
+	if err != nil {
+		slog.Error("smartapp lifecycle request failed", "lifecycle", request.Lifecycle, "execution_id", request.ExecutionID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Warn("responding to smartapp lifecycle request failed", "error", err)
+	}
+}
+
+func (app *SmartApp) handle(ctx context.Context, request *LifecycleRequest) (interface{}, error) {
+	switch request.Lifecycle {
+	case LifecyclePing:
+		if request.PingData == nil {
+			return nil, fmt.Errorf("missing pingData")
+		}
+		return map[string]interface{}{"pingData": request.PingData}, nil
+	case LifecycleConfirmation:
+		if request.ConfirmationData == nil {
+			return nil, fmt.Errorf("missing confirmationData")
+		}
+		if err := app.confirm(ctx, request.ConfirmationData.ConfirmationURL); err != nil {
+			return nil, err
+		}
+		return map[string]string{"targetUrl": request.ConfirmationData.ConfirmationURL}, nil
+	case LifecycleConfiguration:
+		if request.ConfigurationData == nil {
+			return nil, fmt.Errorf("missing configurationData")
+		}
+		return map[string]interface{}{"configurationData": app.configuration(request.ConfigurationData)}, nil
+	case LifecycleInstall, LifecycleUpdate:
+		data := request.InstallData
+		key := "installData"
+		if request.Lifecycle == LifecycleUpdate {
+			data, key = request.UpdateData, "updateData"
+		}
+		if data == nil || data.InstalledApp == nil {
+			return nil, fmt.Errorf("missing %s", key)
+		}
+		if app.OnInstall != nil {
+			if err := app.OnInstall(ctx, data); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{key: struct{}{}}, nil
+	case LifecycleEvent:
+		if request.EventData == nil {
+			return nil, fmt.Errorf("missing eventData")
+		}
+		if app.OnEvent != nil {
+			if err := app.OnEvent(ctx, request.EventData); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{"eventData": struct{}{}}, nil
+	case LifecycleUninstall:
+		if app.OnUninstall != nil && request.UninstallData != nil {
+			if err := app.OnUninstall(ctx, request.UninstallData); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{"uninstallData": struct{}{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported lifecycle %q", request.Lifecycle)
+	}
+}
+
+// configuration has a single page without settings, the app only needs
+// its permissions.
+func (app *SmartApp) configuration(data *ConfigurationData) interface{} {
+	if data.Phase == "INITIALIZE" {
+		return map[string]interface{}{
+			"initialize": map[string]interface{}{
+				"id":          app.ID,
+				"name":        app.Name,
+				"description": app.Description,
+				"permissions": app.Permissions,
+				"firstPageId": "1",
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"page": map[string]interface{}{
+			"pageId":         "1",
+			"name":           app.Name,
+			"nextPageId":     nil,
+			"previousPageId": nil,
+			"complete":       true,
+			"sections":       []interface{}{},
+		},
+	}
+}
+
+// checkConfirmationURL only allows https urls of the smartthings api, the
+// url comes from the request body so anything else isn't fetched.
+func checkConfirmationURL(confirmationURL string) error {
+	u, err := url.Parse(confirmationURL)
+	if err != nil {
+		return fmt.Errorf("invalid confirmation url: %w", err)
+	}
+	host := u.Hostname()
+	if u.Scheme != "https" || u.User != nil || (u.Port() != "" && u.Port() != "443") ||
+		(host != "api.smartthings.com" && !strings.HasSuffix(host, ".api.smartthings.com")) {
+		return fmt.Errorf("confirmation url %q is not an https url of the smartthings api", confirmationURL)
+	}
+	return nil
+}
+
+func (app *SmartApp) confirm(ctx context.Context, confirmationURL string) error {
+	if err := checkConfirmationURL(confirmationURL); err != nil {
+		return err
+	}
+
+	httpClient := app.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, confirmationURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("failed confirmation: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package smartthings
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmartAppLifecycle(t *testing.T) {
+	confirmed := false
+	confirmation := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		confirmed = r.Host == "api.smartthings.com"
+	}))
+	defer confirmation.Close()
+	confirmationURL := "https://api.smartthings.com/apps/app/confirm-registration?token=abc"
+
+	// the smartthings api is served by the test server
+	transport := confirmation.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, confirmation.Listener.Addr().String())
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	app := &SmartApp{ID: "test-app", Name: "test app", Permissions: []string{"r:devices:*"}, HTTPClient: &http.Client{Transport: transport}}
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"ping", http.MethodPost, `{"lifecycle":"PING","pingData":{"challenge":"abc"}}`,
+			http.StatusOK, `{"pingData":{"challenge":"abc"}}`},
+		{"confirmation", http.MethodPost, `{"lifecycle":"CONFIRMATION","confirmationData":{"appId":"app","confirmationUrl":"` + confirmationURL + `"}}`,
+			http.StatusOK, `{"targetUrl":"` + confirmationURL + `"}`},
+		{"confirmation elsewhere", http.MethodPost, `{"lifecycle":"CONFIRMATION","confirmationData":{"appId":"app","confirmationUrl":"http://169.254.169.254/"}}`,
+			http.StatusInternalServerError, ""},
+		{"configuration initialize", http.MethodPost, `{"lifecycle":"CONFIGURATION","configurationData":{"phase":"INITIALIZE"}}`,
+			http.StatusOK, `{"configurationData":{"initialize":{"id":"test-app","name":"test app","description":"","permissions":["r:devices:*"],"firstPageId":"1"}}}`},
+		{"configuration page", http.MethodPost, `{"lifecycle":"CONFIGURATION","configurationData":{"phase":"PAGE","pageId":"1"}}`,
+			http.StatusOK, `{"configurationData":{"page":{"pageId":"1","name":"test app","nextPageId":null,"previousPageId":null,"complete":true,"sections":[]}}}`},
+		{"update", http.MethodPost, `{"lifecycle":"UPDATE","updateData":{"installedApp":{"installedAppId":"id"}}}`,
+			http.StatusOK, `{"updateData":{}}`},
+		{"uninstall", http.MethodPost, `{"lifecycle":"UNINSTALL","uninstallData":{}}`,
+			http.StatusOK, `{"uninstallData":{}}`},
+		{"missing data", http.MethodPost, `{"lifecycle":"INSTALL"}`, http.StatusInternalServerError, ""},
+		{"unknown lifecycle", http.MethodPost, `{"lifecycle":"OTHER"}`, http.StatusInternalServerError, ""},
+		{"invalid body", http.MethodPost, `{`, http.StatusBadRequest, ""},
+		{"wrong method", http.MethodGet, ``, http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			app.ServeHTTP(rec, httptest.NewRequest(test.method, "/", strings.NewReader(test.body)))
+
+			assert.Equal(t, test.wantStatus, rec.Code)
+			if test.wantBody != "" {
+				assert.JSONEq(t, test.wantBody, rec.Body.String())
+			}
+		})
+	}
+	assert.True(t, confirmed)
+}
+
+func TestCheckConfirmationURL(t *testing.T) {
+	for confirmationURL, valid := range map[string]bool{
+		"https://api.smartthings.com/apps/app/confirm-registration?token=abc": true,
+		"https://graph-eu01-euwest1.api.smartthings.com/confirm":              true,
+		"http://api.smartthings.com/confirm":                                  false,
+		"https://api.smartthings.com:8443/confirm":                            false,
+		"https://user@api.smartthings.com/confirm":                            false,
+		"https://api.smartthings.com.example.com/confirm":                     false,
+		"https://169.254.169.254/latest/meta-data":                            false,
+		"https://localhost/confirm":                                           false,
+		"://":                                                                 false,
+	} {
+		err := checkConfirmationURL(confirmationURL)
+		assert.Equal(t, valid, err == nil, "%s: %v", confirmationURL, err)
+	}
+}
@@ -0,0 +1,278 @@
+// Package smartthingstest provides an in-memory fake of the smartthings api
+// for testing code using the smartthings client without a real token.
+package smartthingstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+// Token is the api token the server accepts unless Fixture.Token is set.
+const Token = "smartthingstest-token"
+
+// Fixture is the data served by a Server, it uses the same json format as
+// the snapshots of the exporter. Status is keyed by device id and then
+// component id.
+type Fixture struct {
+	Token     string                                            `json:"token,omitempty"`
+	Locations []*smartthings.Location                           `json:"locations"`
+	Rooms     []*smartthings.Room                               `json:"rooms"`
+	Devices   []*smartthings.Device                             `json:"devices"`
+	Status    map[string]map[string]smartthings.ComponentStatus `json:"status"`
+}
+
+// LoadFixture reads a json fixture file.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &fixture, nil
+}
+
+type failure struct {
+	code  int
+	times int
+}
+
+// Server emulates the device, location and room endpoints of the api,
+// with paging, injected errors and throttling.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	fixture    *Fixture
+	pageSize   int
+	failures   map[string]*failure
+	throttled  int
+	retryAfter time.Duration
+	requests   map[string]int
+}
+
+// NewServer starts a server serving fixture, it is closed with Close.
+func NewServer(fixture *Fixture) *Server {
+	if fixture == nil {
+		fixture = &Fixture{}
+	}
+	if fixture.Token == "" {
+		fixture.Token = Token
+	}
+	if fixture.Status == nil {
+		fixture.Status = make(map[string]map[string]smartthings.ComponentStatus)
+	}
+
+	server := &Server{
+		fixture:  fixture,
+		failures: make(map[string]*failure),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/devices", server.devices)
+	mux.HandleFunc("GET /v1/devices/{deviceId}/components/{componentId}/status", server.componentStatus)
+	mux.HandleFunc("GET /v1/locations", server.locations)
+	mux.HandleFunc("GET /v1/locations/{locationId}/rooms", server.rooms)
+	server.Server = httptest.NewServer(server.middleware(mux))
+
+	return server
+}
+
+// NewFixtureServer starts a server serving the json fixture file at path.
+func NewFixtureServer(path string) (*Server, error) {
+	fixture, err := LoadFixture(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(fixture), nil
+}
+
+// Client returns a client authenticated against the server.
+func (server *Server) Client() *smartthings.Client {
+	client := smartthings.NewClient(server.fixture.Token, server.Server.Client())
+	client.SetBaseURL(server.APIURL())
+	return client
+}
+
+// APIURL is the base url to use instead of smartthings.API.
+func (server *Server) APIURL() string {
+	return server.URL + "/v1"
+}
+
+// SetPageSize splits lists into pages of size items, 0 disables paging.
+func (server *Server) SetPageSize(size int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.pageSize = size
+}
+
+// SetStatus replaces the status of a device component.
+func (server *Server) SetStatus(deviceId, componentId string, status smartthings.ComponentStatus) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.fixture.Status[deviceId] == nil {
+		server.fixture.Status[deviceId] = make(map[string]smartthings.ComponentStatus)
+	}
+	server.fixture.Status[deviceId][componentId] = status
+}
+
+// Fail responds to the next times requests of path, like
+// /v1/devices/dev-1/components/main/status, with an error response of
+// code. A negative times fails every request.
+func (server *Server) Fail(path string, code, times int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.failures[path] = &failure{code: code, times: times}
+}
+
+// Throttle responds to the next n requests with 429 Too Many Requests and
+// a Retry-After header of retryAfter.
+func (server *Server) Throttle(n int, retryAfter time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.throttled, server.retryAfter = n, retryAfter
+}
+
+// Requests returns the number of requests made for path, or of all
+// requests with an empty path.
+func (server *Server) Requests(path string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if path == "" {
+		total := 0
+		for _, n := range server.requests {
+			total += n
+		}
+		return total
+	}
+	return server.requests[path]
+}
+
+func (server *Server) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.requests[r.URL.Path]++
+		throttled := server.throttled > 0
+		if throttled {
+			server.throttled--
+		}
+		retryAfter := server.retryAfter
+		var code int
+		if failure, ok := server.failures[r.URL.Path]; ok && failure.times != 0 {
+			code = failure.code
+			failure.times--
+		}
+		token := server.fixture.Token
+		server.mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			writeError(w, http.StatusUnauthorized, "UnauthorizedError", "invalid token")
+			return
+		}
+		if throttled {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			writeError(w, http.StatusTooManyRequests, "TooManyRequestError", "too many requests")
+			return
+		}
+		if code != 0 {
+			writeError(w, code, strings.ReplaceAll(http.StatusText(code), " ", "")+"Error", "injected failure")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (server *Server) devices(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	writeList(server, w, r, server.fixture.Devices)
+}
+
+func (server *Server) componentStatus(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	status, ok := server.fixture.Status[r.PathValue("deviceId")][r.PathValue("componentId")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFoundError", "component status not found")
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (server *Server) locations(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	writeList(server, w, r, server.fixture.Locations)
+}
+
+func (server *Server) rooms(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	locationId := r.PathValue("locationId")
+	rooms := make([]*smartthings.Room, 0)
+	for _, room := range server.fixture.Rooms {
+		if room.LocationID == locationId {
+			rooms = append(rooms, room)
+		}
+	}
+	writeList(server, w, r, rooms)
+}
+
+// writeList writes the page of items requested with ?page=, with a next
+// link while there are more.
+func writeList[T any](server *Server, w http.ResponseWriter, r *http.Request, items []T) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+
+	response := struct {
+		Items []T                    `json:"items"`
+		Links map[string]interface{} `json:"_links"`
+	}{Items: items, Links: map[string]interface{}{}}
+	if response.Items == nil {
+		response.Items = make([]T, 0)
+	}
+
+	if server.pageSize > 0 {
+		start := min(page*server.pageSize, len(items))
+		end := min(start+server.pageSize, len(items))
+		response.Items = items[start:end]
+		if end < len(items) {
+			next := *r.URL
+			query := next.Query()
+			query.Set("page", strconv.Itoa(page+1))
+			next.RawQuery = query.Encode()
+			response.Links["next"] = map[string]string{"href": server.URL + next.RequestURI()}
+		}
+	}
+
+	writeJSON(w, response)
+}
+
+func writeError(w http.ResponseWriter, code int, errorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(&smartthings.ErrorResponse{
+		RequestID: strconv.FormatInt(time.Now().UnixNano(), 36),
+		Error:     &smartthings.Error{Code: errorCode, Message: message},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,83 @@
+package smartthingstest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/setheck/smartthings-exporter/smartthings/smartthingstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixtureServer(t *testing.T) {
+	server, err := smartthingstest.NewFixtureServer("testdata/home.json")
+	require.NoError(t, err)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	devices, err := client.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "Porch Light", devices[0].Label)
+
+	status, err := client.GetDeviceComponentStatus(ctx, "dev-1", "main")
+	require.NoError(t, err)
+	assert.Equal(t, "on", status["switch"]["switch"]["value"])
+
+	_, err = client.GetDeviceComponentStatus(ctx, "dev-1", "missing")
+	assert.Error(t, err)
+
+	locations, err := client.ListLocations(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, locations, 1)
+	assert.Equal(t, "Home", locations[0].Name)
+
+	rooms, err := client.ListRooms(ctx, "loc-1")
+	require.NoError(t, err)
+	assert.Len(t, rooms, 2)
+}
+
+func TestServerPaging(t *testing.T) {
+	fixture := &smartthingstest.Fixture{}
+	for _, id := range []string{"dev-1", "dev-2", "dev-3", "dev-4", "dev-5"} {
+		fixture.Devices = append(fixture.Devices, &smartthings.Device{DeviceID: id})
+	}
+	server := smartthingstest.NewServer(fixture)
+	defer server.Close()
+	server.SetPageSize(2)
+
+	devices, err := server.Client().ListDevices(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 5)
+	assert.Equal(t, "dev-5", devices[4].DeviceID)
+	assert.Equal(t, 3, server.Requests("/v1/devices"))
+}
+
+func TestServerErrors(t *testing.T) {
+	server := smartthingstest.NewServer(&smartthingstest.Fixture{Devices: []*smartthings.Device{{DeviceID: "dev-1"}}})
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	server.Throttle(1, 2*time.Second)
+	_, err := client.ListDevices(ctx)
+	assert.ErrorIs(t, err, smartthings.ErrRateLimited)
+	assert.ErrorContains(t, err, "retry after 2")
+	_, err = client.ListDevices(ctx)
+	assert.NoError(t, err, "only the next request is throttled")
+
+	server.Fail("/v1/devices", http.StatusInternalServerError, 1)
+	_, err = client.ListDevices(ctx)
+	assert.Error(t, err)
+	_, err = client.ListDevices(ctx)
+	assert.NoError(t, err)
+
+	wrong := smartthings.NewClient("wrong-token", nil)
+	wrong.SetBaseURL(server.APIURL())
+	_, err = wrong.ListDevices(ctx)
+	assert.ErrorIs(t, err, smartthings.ErrUnauthorized)
+}
@@ -0,0 +1,122 @@
+package smartthings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoTokenSource = errors.New("no token source")
+
+// TokenSource provides the bearer token for every api request, so tokens
+// can change while the client is in use.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// RefreshableTokenSource is a TokenSource that can replace a token the
+// api rejected, the client refreshes and retries once on a 401.
+type RefreshableTokenSource interface {
+	TokenSource
+	Refresh(ctx context.Context, rejected string) error
+}
+
+// StaticToken is a token that never changes, like a personal access token.
+type StaticToken string
+
+func (token StaticToken) Token(context.Context) (string, error) {
+	return string(token), nil
+}
+
+// FileTokenSource reads the token from a file, like a mounted kubernetes
+// secret, and picks up changes to it through Reload or Watch.
+type FileTokenSource struct {
+	path string
+
+	mu    sync.RWMutex
+	token string
+}
+
+// NewFileTokenSource reads the initial token, the file must exist and not be empty.
+func NewFileTokenSource(path string) (*FileTokenSource, error) {
+	source := &FileTokenSource{path: path}
+	if _, err := source.Reload(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func (source *FileTokenSource) Path() string {
+	return source.path
+}
+
+func (source *FileTokenSource) Token(context.Context) (string, error) {
+	source.mu.RLock()
+	defer source.mu.RUnlock()
+	return source.token, nil
+}
+
+// Reload reads the file again and reports whether the token changed. The
+// current token is kept when the file can't be read or is empty, which
+// happens briefly while a secret is being replaced.
+func (source *FileTokenSource) Reload() (bool, error) {
+	data, err := os.ReadFile(source.path)
+	if err != nil {
+		return false, err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return false, fmt.Errorf("token file %s is empty", source.path)
+	}
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	changed := token != source.token
+	source.token = token
+	return changed, nil
+}
+
+// Watch reloads the file every interval until ctx is done.
+func (source *FileTokenSource) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := source.Reload()
+		if err != nil {
+			slog.Warn("reloading token file failed", "path", source.path, "error", err)
+		} else if changed {
+			slog.Info("reloaded token file", "path", source.path)
+		}
+	}
+}
+
+// tokenSourceHolder allows swapping the token source of a client while
+// requests are in flight, a request keeps the token it started with.
+type tokenSourceHolder struct {
+	mu     sync.RWMutex
+	source TokenSource
+}
+
+func (holder *tokenSourceHolder) get() TokenSource {
+	holder.mu.RLock()
+	defer holder.mu.RUnlock()
+	return holder.source
+}
+
+func (holder *tokenSourceHolder) set(source TokenSource) {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	holder.source = source
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+// saveSnapshots writes the snapshots as a json list, one per account.
+func saveSnapshots(path string, snapshots []*Snapshot) error {
+	data, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func loadSnapshots(path string) ([]*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("%s: no snapshots", path)
+	}
+	for i, snapshot := range snapshots {
+		if snapshot.Account == "" {
+			return nil, fmt.Errorf("%s: snapshot %d has no account", path, i)
+		}
+	}
+	return snapshots, nil
+}
+
+// dumpSnapshots polls every account once and saves the snapshots to path,
+// nothing is written unless every account succeeded.
+func dumpSnapshots(ctx context.Context, pollers []*Poller, path string) error {
+	var snapshots []*Snapshot
+	var errs []error
+	for _, poller := range pollers {
+		snapshot, err := poller.Poll(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", poller.Name(), err))
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return saveSnapshots(path, snapshots)
+}
+
+// replayPollers returns a poller per snapshot in the file at path, they
+// serve the snapshots through the same conversion as a live account.
+func replayPollers(path string) ([]*Poller, error) {
+	snapshots, err := loadSnapshots(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pollers := make([]*Poller, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		// the snapshot was already limited to the location and filtered
+		pollers = append(pollers, NewPoller(snapshot.Account, &snapshotClient{snapshot: snapshot}, "", DeviceFilter{}, 0))
+	}
+	return pollers, nil
+}
+
+// snapshotClient answers the api calls of a poller from a snapshot.
+type snapshotClient struct {
+	snapshot *Snapshot
+}
+
+func (client *snapshotClient) ListDevices(context.Context) ([]*smartthings.Device, error) {
+	return client.snapshot.Devices, nil
+}
+
+func (client *snapshotClient) ListLocations(context.Context, url.Values) ([]*smartthings.Location, error) {
+	return client.snapshot.Locations, nil
+}
+
+func (client *snapshotClient) ListRooms(_ context.Context, locationId string) ([]*smartthings.Room, error) {
+	var rooms []*smartthings.Room
+	for _, room := range client.snapshot.Rooms {
+		if room.LocationID == locationId {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, nil
+}
+
+func (client *snapshotClient) GetDeviceComponentStatus(_ context.Context, deviceId, componentId string) (smartthings.ComponentStatus, error) {
+	status, ok := client.snapshot.Status[deviceId][componentId]
+	if !ok {
+		return nil, fmt.Errorf("no status of component %s of device %s in the snapshot", componentId, deviceId)
+	}
+	return status, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/setheck/smartthings-exporter/smartthings/smartthingstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpAndReplay(t *testing.T) {
+	home, err := smartthingstest.NewFixtureServer("testdata/devices/thermostat.json")
+	require.NoError(t, err)
+	defer home.Close()
+	cabin, err := smartthingstest.NewFixtureServer("testdata/devices/lock.json")
+	require.NoError(t, err)
+	defer cabin.Close()
+
+	live := []*Poller{
+		NewPoller("home", home.Client(), "", DeviceFilter{}, 0),
+		NewPoller("cabin", cabin.Client(), "", DeviceFilter{}, 0),
+	}
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "snapshot.json")
+	require.NoError(t, dumpSnapshots(context.Background(), live, dump))
+
+	expected := filepath.Join(dir, "live.prom")
+	require.NoError(t, writeGolden(expected, NewCollector(live...)))
+
+	// nothing is served from the api anymore
+	home.Close()
+	cabin.Close()
+
+	replay, err := replayPollers(dump)
+	require.NoError(t, err)
+	require.Len(t, replay, 2)
+	assert.Equal(t, "home", replay[0].Name())
+	assert.Equal(t, "cabin", replay[1].Name())
+
+	exposition, err := os.Open(expected)
+	require.NoError(t, err)
+	defer exposition.Close()
+	assert.NoError(t, testutil.CollectAndCompare(NewCollector(replay...), exposition))
+}
+
+func TestDumpSnapshotsFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	pollers := []*Poller{NewPoller("broken", &fakeClient{err: errors.New("unauthorized")}, "", DeviceFilter{}, 0)}
+
+	assert.ErrorContains(t, dumpSnapshots(context.Background(), pollers, path), "account broken: unauthorized")
+	assert.NoFileExists(t, path)
+}
+
+func TestLoadSnapshotsErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty.json":   `[]`,
+		"invalid.json": `{"account": "home"}`,
+		"unnamed.json": `[{"devices": []}]`,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		_, err := loadSnapshots(path)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// textfileName is the file written to the textfile directory of node_exporter.
+const textfileName = "smartthings.prom"
+
+// errIncompleteMetrics is returned when some metrics couldn't be gathered,
+// like duplicate series, the others were still written.
+var errIncompleteMetrics = errors.New("some metrics couldn't be gathered")
+
+// writeExposition writes the metrics of gatherer in the text format, the
+// metrics that could be gathered are written even on error.
+func writeExposition(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, gatherErr := gatherer.Gather()
+
+	encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	if gatherErr != nil {
+		return fmt.Errorf("%w: %w", errIncompleteMetrics, gatherErr)
+	}
+	return nil
+}
+
+// writeTextfile replaces the file at path with the metrics of gatherer. It
+// writes a temporary file next to it first and renames it, so
+// node_exporter never reads a partial file. The metrics that could be
+// gathered are written even when others couldn't be, which is logged.
+func writeTextfile(path string, gatherer prometheus.Gatherer) error {
+	// node_exporter ignores the temporary file, it doesn't end with .prom
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := writeExposition(file, gatherer); errors.Is(err, errIncompleteMetrics) {
+		slog.Warn("writing textfile without some metrics", "path", path, "error", err)
+	} else if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// runTextfile writes the textfile once every poller polled and then every
+// interval until ctx is done. Without waiting the first file would report
+// every account as down while the pollers initialize.
+func runTextfile(ctx context.Context, path string, interval time.Duration, gatherer prometheus.Gatherer, pollers ...*Poller) {
+	for _, poller := range pollers {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poller.Polled():
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := writeTextfile(path, gatherer); err != nil {
+			slog.Error("writing textfile failed", "path", path, "error", err)
+		} else {
+			slog.Debug("wrote textfile", "path", path)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectOnce polls the pollers and writes their metrics to the textfile
+// in dir, or to w when dir is empty. Failed accounts are reported with
+// smartthings_up 0 like on /metrics.
+func collectOnce(ctx context.Context, pollers []*Poller, dir string, w io.Writer) error {
+	for _, poller := range pollers {
+		// the others poll when they are collected
+		if poller.Status().Interval > 0 {
+			if _, err := poller.Poll(ctx); err != nil {
+				slog.Error("poll account failed", "account", poller.Name(), "error", err)
+			}
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(pollers...))
+	if dir != "" {
+		return writeTextfile(filepath.Join(dir, textfileName), registry)
+	}
+	return writeExposition(w, registry)
+}
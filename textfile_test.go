@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/setheck/smartthings-exporter/smartthings/smartthingstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, textfileName)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0)))
+
+	require.NoError(t, os.WriteFile(path, []byte("stale"), 0644))
+	require.NoError(t, writeTextfile(path, registry))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `smartthings_attribute_switch{account="home",componentId="switch",deviceId="dev-1"} 1`)
+	assert.NotContains(t, string(content), "stale")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "the temporary file is renamed")
+}
+
+func TestWriteTextfileIncomplete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), textfileName)
+	// both components report a switch, of which the series collide
+	client := fixtureClient()
+	client.devices[0].Components = append(client.devices[0].Components, &smartthings.Component{ID: "outlet2"})
+	client.statuses["dev-1/outlet2"] = smartthings.ComponentStatus{"switch": {"switch": {"value": "off"}}}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(NewPoller("home", client, "", DeviceFilter{}, 0)))
+
+	require.NoError(t, writeTextfile(path, registry))
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `smartthings_up{account="home"} 1`)
+	assert.Contains(t, string(content), `deviceId="dev-2"`)
+
+	var out bytes.Buffer
+	assert.ErrorIs(t, writeExposition(&out, registry), errIncompleteMetrics)
+	assert.Contains(t, out.String(), `smartthings_up{account="home"} 1`)
+}
+
+func TestWriteTextfileMissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", textfileName)
+	assert.Error(t, writeTextfile(path, prometheus.NewRegistry()))
+}
+
+func TestRunTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), textfileName)
+	snapshot := fixtureClient().snapshot("home", time.Now())
+	server := smartthingstest.NewServer(&smartthingstest.Fixture{Devices: snapshot.Devices, Status: snapshot.Status})
+	defer server.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(NewPoller("home", server.Client(), "", DeviceFilter{}, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runTextfile(ctx, path, 10*time.Millisecond, registry)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(path)
+		return strings.Contains(string(content), "smartthings_up")
+	}, time.Second, 5*time.Millisecond)
+
+	// the file follows the devices
+	server.SetStatus("dev-1", "main", smartthings.ComponentStatus{"switch": {"switch": {"value": "off"}}})
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(path)
+		return strings.Contains(string(content), `deviceId="dev-1"} 0`)
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestRunTextfileWaitsForFirstPoll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), textfileName)
+	poller := NewPoller("home", fixtureClient(), "", DeviceFilter{}, time.Minute)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(poller))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runTextfile(ctx, path, 10*time.Millisecond, registry, poller)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoFileExists(t, path, "not written before the first poll")
+
+	_, err := poller.Poll(ctx)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(path)
+		return strings.Contains(string(content), `smartthings_up{account="home"} 1`)
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestCollectOnce(t *testing.T) {
+	ctx := context.Background()
+	// a background poller isn't running, so it's polled first
+	pollers := []*Poller{
+		NewPoller("home", fixtureClient(), "", DeviceFilter{}, 0),
+		NewPoller("cabin", fixtureClient(), "", DeviceFilter{}, time.Hour),
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, collectOnce(ctx, pollers, "", &out))
+	assert.Contains(t, out.String(), `smartthings_up{account="home"} 1`)
+	assert.Contains(t, out.String(), `smartthings_up{account="cabin"} 1`)
+	assert.NotContains(t, out.String(), "go_goroutines")
+
+	dir := t.TempDir()
+	out.Reset()
+	require.NoError(t, collectOnce(ctx, pollers, dir, &out))
+	assert.Empty(t, out.String())
+	assert.FileExists(t, filepath.Join(dir, textfileName))
+}
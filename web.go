@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/exporter-toolkit/web"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// publicPaths are served without basic auth: smartthings can't
+// authenticate to the webhook or the oauth redirect, and neither can the
+// health checks of an orchestrator.
+var publicPaths = []string{"/webhook", "/oauth/callback", "/healthz", "/readyz"}
+
+// unknownUserHash is compared against for unknown users, so they can't be
+// told apart from wrong passwords by the response time.
+const unknownUserHash = "$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
+
+// maxCachedLogins bounds the cache of bcrypt comparisons.
+const maxCachedLogins = 100
+
+// WebServer serves with an exporter-toolkit web config file. Unlike
+// web.ListenAndServe the basic auth users don't protect the publicPaths.
+// The file is read again on every request and tls handshake.
+type WebServer struct {
+	path string
+
+	mu     sync.Mutex
+	logins map[string]bool
+}
+
+// NewWebServer validates the web config file at path, an empty path
+// serves plain http without authentication.
+func NewWebServer(path string) (*WebServer, error) {
+	if path != "" {
+		if err := web.Validate(path); err != nil {
+			return nil, err
+		}
+	}
+	return &WebServer{path: path, logins: make(map[string]bool)}, nil
+}
+
+// load reads the web config with the defaults of the exporter-toolkit.
+func (webServer *WebServer) load() (*web.Config, error) {
+	data, err := os.ReadFile(webServer.path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &web.Config{
+		TLSConfig: web.TLSConfig{
+			MinVersion:               tls.VersionTLS12,
+			MaxVersion:               tls.VersionTLS13,
+			PreferServerCipherSuites: true,
+		},
+		HTTPConfig: web.HTTPConfig{HTTP2: true},
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	config.TLSConfig.SetDirectory(filepath.Dir(webServer.path))
+	return config, nil
+}
+
+// ListenAndServe serves server with the tls settings of the web config,
+// or plain http without them.
+func (webServer *WebServer) ListenAndServe(server *http.Server) error {
+	if webServer.path == "" {
+		return server.ListenAndServe()
+	}
+
+	handler := server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server.Handler = webServer.handler(handler)
+
+	config, err := webServer.load()
+	if err != nil {
+		return err
+	}
+	if !tlsEnabled(&config.TLSConfig) {
+		slog.Info("tls is disabled", "address", server.Addr)
+		return server.ListenAndServe()
+	}
+	if server.TLSConfig, err = web.ConfigToTLSConfig(&config.TLSConfig); err != nil {
+		return err
+	}
+	if !config.HTTPConfig.HTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	// picks up renewed certificates without a restart
+	server.TLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config, err := webServer.load()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := web.ConfigToTLSConfig(&config.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.NextProtos = server.TLSConfig.NextProtos
+		return tlsConfig, nil
+	}
+
+	slog.Info("tls is enabled", "address", server.Addr, "http2", config.HTTPConfig.HTTP2)
+	return server.ListenAndServeTLS("", "")
+}
+
+// handler adds the configured headers to every response, and requires
+// basic auth outside of the publicPaths when there are users.
+func (webServer *WebServer) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := webServer.load()
+		if err != nil {
+			slog.Error("reading web config failed", "path", webServer.path, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		for name, value := range config.HTTPConfig.Header {
+			w.Header().Set(name, value)
+		}
+
+		if len(config.Users) == 0 || slices.Contains(publicPaths, r.URL.Path) || webServer.authenticated(config.Users, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// authenticated checks the basic auth of r, the results are cached as
+// bcrypt is slow on purpose.
+func (webServer *WebServer) authenticated(users map[string]config_util.Secret, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := users[user]
+	if !known {
+		hash = unknownUserHash
+	}
+	sum := sha256.Sum256([]byte(user + "\x00" + string(hash) + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+
+	// also runs a single comparison at a time, they are cpu intensive
+	webServer.mu.Lock()
+	defer webServer.mu.Unlock()
+	if authenticated, ok := webServer.logins[key]; ok {
+		return authenticated
+	}
+	authenticated := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil && known
+	if len(webServer.logins) >= maxCachedLogins {
+		clear(webServer.logins)
+	}
+	webServer.logins[key] = authenticated
+	return authenticated
+}
+
+// tlsEnabled reports whether the web config has tls settings, the
+// exporter-toolkit serves plain http otherwise.
+func tlsEnabled(config *web.TLSConfig) bool {
+	return config.TLSCertPath != "" || config.TLSCert != "" ||
+		config.TLSKeyPath != "" || config.TLSKey != "" ||
+		config.ClientCAs != "" || config.ClientCAsText != "" ||
+		config.ClientAuth != ""
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 to dir.
+func writeCertificate(t *testing.T, dir string, key *rsa.PrivateKey) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smartthings-exporter"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	keyDer := x509.MarshalPKCS1PrivateKey(key)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server.key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func TestWebServer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	users := "basic_auth_users:\n  prometheus: " + string(hash) + "\n"
+
+	for _, test := range []struct {
+		name      string
+		webConfig string
+		scheme    string
+	}{
+		{"http", users, "http"},
+		{"https", "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n" + users, "https"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeCertificate(t, dir, key)
+			webConfigFile := filepath.Join(dir, "web.config.yml")
+			require.NoError(t, os.WriteFile(webConfigFile, []byte(test.webConfig), 0600))
+			webServer, err := NewWebServer(webConfigFile)
+			require.NoError(t, err)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			addr := listener.Addr().String()
+			require.NoError(t, listener.Close())
+
+			verifier := smartthings.NewTestSignatureVerifier(map[string]*rsa.PublicKey{"/test/key": &key.PublicKey})
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			mux.Handle("/healthz", LivenessHandler{})
+			mux.Handle("/webhook", verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			server := &http.Server{Addr: addr, Handler: mux}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				done <- serve(ctx, server, time.Second, func() error { return webServer.ListenAndServe(server) })
+			}()
+			defer func() {
+				cancel()
+				assert.NoError(t, <-done)
+			}()
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+			request := func(method, path, user, password string, sign bool) int {
+				req, _ := http.NewRequest(method, test.scheme+"://"+addr+path, strings.NewReader(`{"lifecycle":"PING"}`))
+				if user != "" {
+					req.SetBasicAuth(user, password)
+				}
+				if sign {
+					require.NoError(t, smartthings.SignRequest(req, "/test/key", key))
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					return 0
+				}
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			require.Eventually(t, func() bool { return request(http.MethodGet, "/healthz", "", "", false) != 0 }, time.Second, 10*time.Millisecond)
+			assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/metrics", "", "", false))
+			assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/metrics", "prometheus", "wrong", false))
+			assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/metrics", "other", "secret", false))
+			assert.Equal(t, http.StatusOK, request(http.MethodGet, "/metrics", "prometheus", "secret", false))
+			assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/", "", "", false), "unknown paths are protected")
+
+			assert.Equal(t, http.StatusOK, request(http.MethodGet, "/healthz", "", "", false))
+			assert.Equal(t, http.StatusOK, request(http.MethodPost, "/webhook", "", "", true), "smartthings can't authenticate")
+			assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/webhook", "", "", false), "the signature is still verified")
+		})
+	}
+}
+
+func TestNewWebServerInvalidConfig(t *testing.T) {
+	webConfigFile := filepath.Join(t.TempDir(), "web.config.yml")
+	require.NoError(t, os.WriteFile(webConfigFile, []byte("basic_auth_users:\n  prometheus: plaintext\n"), 0600))
+	_, err := NewWebServer(webConfigFile)
+	assert.Error(t, err)
+
+	webServer, err := NewWebServer("")
+	require.NoError(t, err)
+	assert.NotNil(t, webServer)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/setheck/smartthings-exporter/smartthings"
+)
+
+// SubscriptionClient is the part of the smartthings client used with the
+// token of an installed app.
+type SubscriptionClient interface {
+	ListDevices(ctx context.Context) ([]*smartthings.Device, error)
+	DeleteAllSubscriptions(ctx context.Context, installedAppId string) error
+	CreateSubscription(ctx context.Context, installedAppId string, subscription *smartthings.Subscription) (*smartthings.Subscription, error)
+}
+
+// Webhook keeps the pollers up to date with device events pushed to a
+// webhook smartapp, polling is then only needed to reconcile.
+type Webhook struct {
+	pollers   []*Poller
+	newClient func(token string) SubscriptionClient
+}
+
+func NewWebhook(newClient func(token string) SubscriptionClient, pollers ...*Poller) *Webhook {
+	return &Webhook{pollers: pollers, newClient: newClient}
+}
+
+// SmartApp returns the lifecycle handler for the webhook.
+func (webhook *Webhook) SmartApp() *smartthings.SmartApp {
+	return &smartthings.SmartApp{
+		ID:          "smartthings-exporter",
+		Name:        "smartthings-exporter",
+		Description: "pushes device events to the smartthings exporter",
+		Permissions: []string{"r:devices:*", "r:locations:*"},
+		OnInstall:   webhook.install,
+		OnEvent:     webhook.event,
+	}
+}
+
+// maxSubscriptions is the limit of subscriptions of an installed app.
+const maxSubscriptions = 20
+
+// install replaces the subscriptions of the installed app with one for
+// every capability of the devices in its location. Beyond the limit, the
+// least used capabilities are left to the reconciliation polls.
+func (webhook *Webhook) install(ctx context.Context, data *smartthings.InstallData) error {
+	installedApp := data.InstalledApp
+	client := webhook.newClient(data.AuthToken)
+
+	if err := client.DeleteAllSubscriptions(ctx, installedApp.InstalledAppID); err != nil {
+		return fmt.Errorf("delete subscriptions: %w", err)
+	}
+
+	devices, err := client.ListDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("list devices: %w", err)
+	}
+
+	capabilities := locationCapabilities(devices, installedApp.LocationID)
+	if len(capabilities) > maxSubscriptions {
+		slog.Warn("webhook can't subscribe to every capability, the others are updated by polling",
+			"installed_app_id", installedApp.InstalledAppID, "capabilities", len(capabilities), "unsubscribed", capabilities[maxSubscriptions:])
+		capabilities = capabilities[:maxSubscriptions]
+	}
+
+	var errs []error
+	subscribed := 0
+	for _, capability := range capabilities {
+		subscription := &smartthings.Subscription{
+			SourceType: smartthings.SubscriptionSourceCapability,
+			Capability: &smartthings.CapabilitySubscription{
+				LocationID:       installedApp.LocationID,
+				Capability:       capability,
+				Attribute:        "*",
+				Value:            "*",
+				StateChangeOnly:  true,
+				SubscriptionName: capability,
+			},
+		}
+		if _, err := client.CreateSubscription(ctx, installedApp.InstalledAppID, subscription); err != nil {
+			// the capability is still updated by the reconciliation polls
+			slog.Error("webhook subscription failed", "installed_app_id", installedApp.InstalledAppID, "capability", capability, "error", err)
+			errs = append(errs, fmt.Errorf("subscribe to capability %s: %w", capability, err))
+			continue
+		}
+		subscribed++
+	}
+	if subscribed == 0 && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	slog.Info("webhook subscribed to capabilities", "installed_app_id", installedApp.InstalledAppID, "capabilities", subscribed, "failed", len(errs))
+	return nil
+}
+
+// locationCapabilities lists the capabilities of the devices in a
+// location, the ones of the most devices first.
+func locationCapabilities(devices []*smartthings.Device, locationId string) []string {
+	counts := make(map[string]int)
+	for _, device := range devices {
+		if device.LocationID != "" && device.LocationID != locationId {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, component := range device.Components {
+			for _, capability := range component.Capabilities {
+				if !seen[capability.ID] {
+					seen[capability.ID] = true
+					counts[capability.ID]++
+				}
+			}
+		}
+	}
+
+	capabilities := make([]string, 0, len(counts))
+	for capability := range counts {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Slice(capabilities, func(i, j int) bool {
+		if counts[capabilities[i]] != counts[capabilities[j]] {
+			return counts[capabilities[i]] > counts[capabilities[j]]
+		}
+		return capabilities[i] < capabilities[j]
+	})
+	return capabilities
+}
+
+func (webhook *Webhook) event(_ context.Context, data *smartthings.EventData) error {
+	for _, event := range data.Events {
+		if event.EventType != smartthings.EventTypeDevice || event.DeviceEvent == nil {
+			continue
+		}
+
+		applied := false
+		for _, poller := range webhook.pollers {
+			applied = poller.ApplyEvent(event.DeviceEvent) || applied
+		}
+		if !applied {
+			// picked up by the next reconciliation poll
+			slog.Debug("webhook event for unknown device", "device_id", event.DeviceEvent.DeviceID)
+		}
+	}
+
+	return nil
+}
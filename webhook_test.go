@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/setheck/smartthings-exporter/smartthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSubscriptionClient struct {
+	token         string
+	devices       []*smartthings.Device
+	deleted       []string
+	subscriptions []*smartthings.Subscription
+	failing       map[string]bool
+}
+
+func (client *fakeSubscriptionClient) ListDevices(context.Context) ([]*smartthings.Device, error) {
+	return client.devices, nil
+}
+
+func (client *fakeSubscriptionClient) DeleteAllSubscriptions(_ context.Context, installedAppId string) error {
+	client.deleted = append(client.deleted, installedAppId)
+	return nil
+}
+
+func (client *fakeSubscriptionClient) CreateSubscription(_ context.Context, installedAppId string, subscription *smartthings.Subscription) (*smartthings.Subscription, error) {
+	if client.failing[subscription.Capability.Capability] {
+		return nil, errors.New("unprocessable entity")
+	}
+	subscription.InstalledAppId = installedAppId
+	client.subscriptions = append(client.subscriptions, subscription)
+	return subscription, nil
+}
+
+// capabilities creates a main component with the capabilities.
+func capabilities(ids ...string) []*smartthings.Component {
+	component := &smartthings.Component{ID: "main"}
+	for _, id := range ids {
+		component.Capabilities = append(component.Capabilities, &smartthings.Capability{ID: id})
+	}
+	return []*smartthings.Component{component}
+}
+
+func installWebhook(t *testing.T, subscriptionClient *fakeSubscriptionClient) *httptest.ResponseRecorder {
+	webhook := NewWebhook(func(token string) SubscriptionClient {
+		subscriptionClient.token = token
+		return subscriptionClient
+	})
+
+	body := `{"lifecycle":"INSTALL","installData":{"authToken":"app-token","installedApp":{"installedAppId":"app-1","locationId":"loc-1"}}}`
+	rec := httptest.NewRecorder()
+	webhook.SmartApp().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+	return rec
+}
+
+func TestWebhookInstall(t *testing.T) {
+	subscriptionClient := &fakeSubscriptionClient{
+		devices: []*smartthings.Device{
+			{DeviceID: "dev-1", LocationID: "loc-1", Components: capabilities("switch", "powerMeter")},
+			{DeviceID: "dev-2", LocationID: "loc-1", Components: capabilities("switch")},
+			{DeviceID: "dev-3", LocationID: "loc-2", Components: capabilities("lock")},
+		},
+	}
+	rec := installWebhook(t, subscriptionClient)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"installData":{}}`, rec.Body.String())
+	assert.Equal(t, "app-token", subscriptionClient.token)
+	assert.Equal(t, []string{"app-1"}, subscriptionClient.deleted)
+	require.Len(t, subscriptionClient.subscriptions, 2)
+	subscription := subscriptionClient.subscriptions[0]
+	assert.Equal(t, smartthings.SubscriptionSourceCapability, subscription.SourceType)
+	assert.Equal(t, &smartthings.CapabilitySubscription{
+		LocationID: "loc-1", Capability: "switch", Attribute: "*", Value: "*", StateChangeOnly: true, SubscriptionName: "switch",
+	}, subscription.Capability)
+	assert.Equal(t, "powerMeter", subscriptionClient.subscriptions[1].Capability.Capability)
+}
+
+func TestWebhookInstallLimit(t *testing.T) {
+	var ids []string
+	for i := 0; i < maxSubscriptions+5; i++ {
+		ids = append(ids, fmt.Sprintf("capability%02d", i))
+	}
+	subscriptionClient := &fakeSubscriptionClient{
+		devices: []*smartthings.Device{
+			{DeviceID: "dev-1", LocationID: "loc-1", Components: capabilities(ids...)},
+			{DeviceID: "dev-2", LocationID: "loc-1", Components: capabilities("switch")},
+			{DeviceID: "dev-3", LocationID: "loc-1", Components: capabilities("switch")},
+		},
+		failing: map[string]bool{"capability00": true},
+	}
+	rec := installWebhook(t, subscriptionClient)
+
+	require.Equal(t, http.StatusOK, rec.Code, "failed subscriptions are left to polling")
+	require.Len(t, subscriptionClient.subscriptions, maxSubscriptions-1)
+	assert.Equal(t, "switch", subscriptionClient.subscriptions[0].Capability.Capability, "the most used capabilities come first")
+	assert.Equal(t, "capability01", subscriptionClient.subscriptions[1].Capability.Capability)
+
+	subscriptionClient = &fakeSubscriptionClient{
+		devices: []*smartthings.Device{{DeviceID: "dev-1", LocationID: "loc-1", Components: capabilities("switch")}},
+		failing: map[string]bool{"switch": true},
+	}
+	rec = installWebhook(t, subscriptionClient)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "an install without any subscription fails")
+}
+
+func TestWebhookEvent(t *testing.T) {
+	client := &fakeClient{
+		devices: []*smartthings.Device{
+			{DeviceID: "dev-1", Components: []*smartthings.Component{{ID: "main"}}},
+		},
+		statuses: map[string]smartthings.ComponentStatus{
+			"dev-1/main": {"switch": {"switch": {"value": "off"}}},
+		},
+	}
+	poller := NewPoller("home", client, "", DeviceFilter{}, time.Minute)
+	_, err := poller.Poll(context.Background())
+	require.NoError(t, err)
+	before, _ := poller.Snapshot(context.Background())
+
+	body := `{"lifecycle":"EVENT","eventData":{"events":[
+		{"eventType":"DEVICE_EVENT","deviceEvent":{"deviceId":"dev-1","componentId":"main","capability":"switch","attribute":"switch","value":"on"}},
+		{"eventType":"DEVICE_EVENT","deviceEvent":{"deviceId":"dev-1","componentId":"main","capability":"temperatureMeasurement","attribute":"temperature","value":21.5}}
+	]}}`
+	rec := httptest.NewRecorder()
+	NewWebhook(nil, poller).SmartApp().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	expected := `
+# HELP smartthings_attribute_switch 
+# TYPE smartthings_attribute_switch gauge
+smartthings_attribute_switch{account="home",componentId="switch",deviceId="dev-1"} 1
+# HELP smartthings_attribute_temperature 
+# TYPE smartthings_attribute_temperature gauge
+smartthings_attribute_temperature{account="home",componentId="temperatureMeasurement",deviceId="dev-1"} 21.5
+`
+	err = testutil.CollectAndCompare(NewCollector(poller), strings.NewReader(expected),
+		"smartthings_attribute_switch", "smartthings_attribute_temperature")
+	assert.NoError(t, err)
+	assert.Equal(t, "off", before.Status["dev-1"]["main"]["switch"]["switch"]["value"], "earlier snapshots are not modified")
+}